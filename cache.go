@@ -37,6 +37,7 @@ var (
 // All methods accepts as interface{} because argument can be passed as string or *Item
 type Cache interface {
 	Get(item interface{}) ([]byte, error)
+	GetWithMeta(item interface{}) (*Entry, error)
 	Set(args ...interface{}) error
 	Del(items ...interface{}) error
 	Unlink(items ...interface{}) error
@@ -0,0 +1,212 @@
+package relevantcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Kinds of cascade action, smaller one is stronger
+const (
+	cascadeActionDelete = byte(1)
+	cascadeActionExpire = byte(2)
+	cascadeActionStale  = byte(3)
+)
+
+// Action which is applied to the record when it's reached by cascading deletion.
+// Keys which are passed to Del or Unlink are always deleted.
+type CascadeAction struct {
+	kind byte
+	ttl  time.Duration
+}
+
+var (
+	// Delete the record, this is the default
+	CascadeDelete = CascadeAction{kind: cascadeActionDelete}
+	// Keep the record and mark it stale. Get treats stale record as missing, and GetStale still reads it
+	CascadeStale = CascadeAction{kind: cascadeActionStale}
+)
+
+// Shorten TTL of the record to d. TTL which is already shorter than d is kept
+func CascadeExpire(d time.Duration) CascadeAction {
+	return CascadeAction{
+		kind: cascadeActionExpire,
+		ttl:  d,
+	}
+}
+
+func (a CascadeAction) String() string {
+	switch a.kind {
+	case cascadeActionDelete:
+		return "delete"
+	case cascadeActionExpire:
+		return fmt.Sprintf("expire(%s)", a.ttl)
+	case cascadeActionStale:
+		return "stale"
+	default:
+		return "unset"
+	}
+}
+
+// Report whether the action is set
+func (a CascadeAction) isSet() bool {
+	return a.kind != 0
+}
+
+// Report whether the action is stronger than b. Delete is the strongest, and shorter expiration is stronger
+func (a CascadeAction) stronger(b CascadeAction) bool {
+	if a.kind != b.kind {
+		return a.kind < b.kind
+	}
+	return a.kind == cascadeActionExpire && a.ttl < b.ttl
+}
+
+func writeCascadeAction(buf *bytes.Buffer, a CascadeAction) {
+	buf.WriteByte(a.kind)
+	writeUvarint(buf, uint64(a.ttl/time.Millisecond))
+}
+
+func readCascadeAction(s []byte, p int) (CascadeAction, int, error) {
+	if p >= len(s) || s[p] > cascadeActionStale {
+		return CascadeAction{}, p, fmt.Errorf("invalid cascade action at offset %d", p)
+	}
+	kind := s[p]
+	ttl, p, err := readUvarint(s, p+1)
+	if err != nil {
+		return CascadeAction{}, p, err
+	}
+	return CascadeAction{kind: kind, ttl: time.Duration(ttl) * time.Millisecond}, p, nil
+}
+
+// Actions of the record and its relevant keys
+type cascadeActions struct {
+	// Action which is applied to the record itself
+	self CascadeAction
+	// Actions which are applied to relevant keys, key is relevant key
+	edges map[string]CascadeAction
+}
+
+// Encode cascade section as [action of the record][count (uvarint)]([key length (uvarint)][key][action])...
+// Action is [kind][ttl in milliseconds (uvarint)]
+func encodeCascadeSection(c cascadeActions) []byte {
+	buf := new(bytes.Buffer)
+	writeCascadeAction(buf, c.self)
+	writeUvarint(buf, uint64(len(c.edges)))
+	for _, k := range sortedKeys(c.edges) {
+		writeUvarint(buf, uint64(len(k)))
+		buf.WriteString(k)
+		writeCascadeAction(buf, c.edges[k])
+	}
+	return buf.Bytes()
+}
+
+func decodeCascadeSection(s []byte) (cascadeActions, error) {
+	c := cascadeActions{
+		edges: map[string]CascadeAction{},
+	}
+	self, p, err := readCascadeAction(s, 0)
+	if err != nil {
+		return c, err
+	}
+	c.self = self
+	count, p, err := readUvarint(s, p)
+	if err != nil {
+		return c, err
+	}
+	for i := uint64(0); i < count; i++ {
+		var key []byte
+		if key, p, err = readChunk(s, p); err != nil {
+			return c, err
+		}
+		var a CascadeAction
+		if a, p, err = readCascadeAction(s, p); err != nil {
+			return c, err
+		}
+		c.edges[string(key)] = a
+	}
+	return c, nil
+}
+
+func sortedKeys(m map[string]CascadeAction) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get cascade actions of the record, broken section is treated as no actions
+func (r *record) cascadeActions() cascadeActions {
+	s := r.section(flagCascade)
+	if s == nil {
+		return cascadeActions{}
+	}
+	c, err := decodeCascadeSection(s)
+	if err != nil {
+		return cascadeActions{}
+	}
+	return c
+}
+
+// Get action which is applied to relevant key of the record. Returns unset action if it's not specified
+func (r *record) edgeAction(key string) CascadeAction {
+	if r == nil {
+		return CascadeAction{}
+	}
+	return r.cascadeActions().edges[key]
+}
+
+// Resolve action which is applied to the record which is reached by edges.
+// Each edge uses its own action, or action of the record if edge doesn't specify it, and the strongest one wins.
+func resolveCascadeAction(r *record, edges []CascadeAction) CascadeAction {
+	self := CascadeDelete
+	if r != nil {
+		if a := r.cascadeActions().self; a.isSet() {
+			self = a
+		}
+	}
+	var action CascadeAction
+	for _, e := range edges {
+		if !e.isSet() {
+			e = self
+		}
+		if !action.isSet() || e.stronger(action) {
+			action = e
+		}
+	}
+	if !action.isSet() {
+		return self
+	}
+	return action
+}
+
+// Report whether the record is marked as stale
+func (r *record) isStale() bool {
+	return r.flags&flagStale != 0
+}
+
+// Mark the record as stale. Stale section is [marked at unix nano (varint)]
+func markStale(dat []byte, now time.Time) ([]byte, error) {
+	r, err := decodeRecord(dat)
+	if err != nil {
+		return nil, err
+	} else if r == nil {
+		r = newRecord(nil, dat)
+	}
+	r.setSection(flagStale, staleSection(now))
+	return r.encode(), nil
+}
+
+func staleSection(now time.Time) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return b[:binary.PutVarint(b[:], now.UnixNano())]
+}
+
+// Report whether stored data is the record which is marked as stale
+func isStaleRecord(dat []byte) bool {
+	r, err := decodeRecord(dat)
+	return err == nil && r != nil && r.isStale()
+}
@@ -0,0 +1,86 @@
+// Command relevantcache-migrate rewrites records in redis from a record format to another format.
+//
+// Usage:
+//
+//	relevantcache-migrate -endpoint redis://127.0.0.1:6379 -from legacy -to v2 [-match "product_*"] [-batch 100] [-dry-run]
+//
+// Available formats are readme, legacy and v2. Use tls:// scheme for the endpoint to connect with TLS.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	rc "github.com/ysugimoto/relevantcache"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "redis://127.0.0.1:6379", "Redis endpoint, use tls:// for TLS connection")
+	skipVerify := flag.Bool("skip-tls-verify", false, "Skip TLS verification")
+	from := flag.String("from", "legacy", "Source record format: readme, legacy or v2")
+	to := flag.String("to", "v2", "Destination record format: legacy or v2")
+	match := flag.String("match", "*", "Pattern of keys to migrate")
+	batch := flag.Int64("batch", 100, "Count hint of SCAN command")
+	dryRun := flag.Bool("dry-run", false, "Only report without rewriting records")
+	flag.Parse()
+
+	if err := run(*endpoint, *skipVerify, *from, *to, *match, *batch, *dryRun); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(endpoint string, skipVerify bool, from, to, match string, batch int64, dryRun bool) error {
+	fromFormat, err := rc.ParseFormat(from)
+	if err != nil {
+		return err
+	}
+	toFormat, err := rc.ParseFormat(to)
+	if err != nil {
+		return err
+	}
+	c, err := rc.NewRedisCache(endpoint, rc.WithSkipTLSVerify(skipVerify))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	report, err := rc.Migrate(ctx, c, fromFormat, toFormat,
+		rc.WithMigrationMatch(match),
+		rc.WithMigrationBatchSize(batch),
+		rc.WithMigrationDryRun(dryRun),
+		rc.WithMigrationProgress(func(r rc.MigrationReport) {
+			fmt.Fprintf(os.Stderr, "scanned: %d, migrated: %d, skipped: %d, errors: %d\n",
+				r.Scanned, r.Migrated, len(r.Skipped), len(r.Errors))
+		}),
+	)
+	if report != nil {
+		for _, s := range report.Skipped {
+			fmt.Printf("SKIP\t%s\t%s\n", s.Key, s.Reason)
+		}
+		for _, e := range report.Errors {
+			fmt.Printf("ERROR\t%s\t%s\n", e.Key, e.Err.Error())
+		}
+		fmt.Printf("scanned: %d, migrated: %d, unmatched: %d, skipped: %d, errors: %d\n",
+			report.Scanned, report.Migrated, report.Unmatched, len(report.Skipped), len(report.Errors))
+	}
+	if err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d keys are failed to migrate", len(report.Errors))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package relevantcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Codec converts Item value to byte slice and vice versa.
+// ID is recorded in the record header so that we can decode records which are encoded by different codec.
+type Codec interface {
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Built-in codec IDs. IDs less than 16 are reserved for built-in codecs
+const (
+	codecIDRaw      = byte(0)
+	codecIDJSON     = byte(1)
+	codecIDGob      = byte(2)
+	codecIDProtobuf = byte(3)
+)
+
+var (
+	// Raw bytes codec. string and []byte are stored as they are, other values are stored as fmt.Sprint() result.
+	// This is the default codec.
+	RawCodec Codec = rawCodec{}
+	// encoding/json codec
+	JSONCodec Codec = jsonCodec{}
+	// encoding/gob codec
+	GobCodec Codec = gobCodec{}
+	// protobuf codec, value must implement proto.Message
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		codecIDRaw:      RawCodec,
+		codecIDJSON:     JSONCodec,
+		codecIDGob:      GobCodec,
+		codecIDProtobuf: ProtobufCodec,
+	}
+)
+
+// Register custom codec to decode records which are encoded by it.
+// Codec ID must be unique and greater than or equal to 16.
+func RegisterCodec(c Codec) error {
+	if c.ID() < 16 {
+		return fmt.Errorf("codec id %d is reserved for built-in codecs", c.ID())
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[c.ID()]; ok {
+		return fmt.Errorf("codec id %d is already registered", c.ID())
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+func lookupCodec(id byte) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec id: %d", id)
+	}
+	return c, nil
+}
+
+type rawCodec struct{}
+
+func (rawCodec) ID() byte {
+	return codecIDRaw
+}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case string:
+		return []byte(t), nil
+	default:
+		return []byte(fmt.Sprint(v)), nil
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch t := v.(type) {
+	case *[]byte:
+		*t = append((*t)[:0], data...)
+	case *string:
+		*t = string(data)
+	default:
+		return fmt.Errorf("raw codec could not unmarshal to %T, accepts only *[]byte and *string", v)
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return codecIDJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return codecIDGob
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ID() byte {
+	return codecIDProtobuf
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec could not marshal %T, value must implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec could not unmarshal to %T, value must implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
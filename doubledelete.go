@@ -0,0 +1,159 @@
+package relevantcache
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counts of the second deletions of double delete
+type DoubleDeleteStats struct {
+	// Second deletions which are scheduled
+	Scheduled uint64
+	// Second deletions which are done without error
+	Executed uint64
+	// Second deletions which are done with error
+	Failed uint64
+	// Second deletions which are canceled, including ones which are replaced by deleting the key again and ones on Close
+	Canceled uint64
+	// Second deletions which are waiting
+	Pending int
+}
+
+// Schedule the second deletion of each root key after delay, so that stale data which concurrent readers
+// write back around the first deletion is deleted again.
+type doubleDeleter struct {
+	delay time.Duration
+	// Delete keys without scheduling the second deletion again
+	del func(method string, keys ...interface{}) error
+	w   io.Writer
+
+	mu      sync.Mutex
+	pending map[string]*pendingDelete
+	closed  bool
+	wg      sync.WaitGroup
+
+	scheduled, executed, failed, canceled uint64
+}
+
+// Second deletion which is waiting for the timer
+type pendingDelete struct {
+	timer *time.Timer
+}
+
+func newDoubleDeleter(delay time.Duration, w io.Writer, del func(method string, keys ...interface{}) error) *doubleDeleter {
+	return &doubleDeleter{
+		delay:   delay,
+		del:     del,
+		w:       w,
+		pending: map[string]*pendingDelete{},
+	}
+}
+
+// Schedule the second deletion of items. Nothing is scheduled if double delete is disabled
+func (d *doubleDeleter) schedule(method string, items ...interface{}) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	for _, v := range items {
+		key, err := getKey(v)
+		if err != nil {
+			continue
+		}
+		// Timer which already fired skips the deletion because it's no longer pending
+		if p, ok := d.pending[key]; ok {
+			p.timer.Stop()
+			atomic.AddUint64(&d.canceled, 1)
+		}
+		p := &pendingDelete{}
+		p.timer = time.AfterFunc(d.delay, func() {
+			d.fire(method, key, p)
+		})
+		d.pending[key] = p
+		atomic.AddUint64(&d.scheduled, 1)
+		debug(d.w, fmt.Sprintf("[DOUBLE-DELETE] delete %s again after %s\n", key, d.delay))
+	}
+}
+
+// Run the second deletion of key if p is still pending
+func (d *doubleDeleter) fire(method, key string, p *pendingDelete) {
+	d.mu.Lock()
+	if d.closed || d.pending[key] != p {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	d.wg.Add(1)
+	d.mu.Unlock()
+	defer d.wg.Done()
+
+	debug(d.w, fmt.Sprintf("[DOUBLE-DELETE] key is: %s\n", key))
+	if err := d.del(method, key); err != nil {
+		debug(d.w, fmt.Sprintf("[DOUBLE-DELETE] %s\n", err.Error()))
+		atomic.AddUint64(&d.failed, 1)
+		return
+	}
+	atomic.AddUint64(&d.executed, 1)
+}
+
+// Cancel pending second deletions of items, and returns the count of canceled ones
+func (d *doubleDeleter) cancel(items ...interface{}) int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, v := range items {
+		key, err := getKey(v)
+		if err != nil {
+			continue
+		}
+		if p, ok := d.pending[key]; ok {
+			delete(d.pending, key)
+			p.timer.Stop()
+			n++
+		}
+	}
+	atomic.AddUint64(&d.canceled, uint64(n))
+	return n
+}
+
+// Cancel all pending second deletions, and wait for running ones
+func (d *doubleDeleter) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.closed = true
+	for key, p := range d.pending {
+		delete(d.pending, key)
+		p.timer.Stop()
+		atomic.AddUint64(&d.canceled, 1)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *doubleDeleter) stats() DoubleDeleteStats {
+	if d == nil {
+		return DoubleDeleteStats{}
+	}
+	d.mu.Lock()
+	pending := len(d.pending)
+	d.mu.Unlock()
+	return DoubleDeleteStats{
+		Scheduled: atomic.LoadUint64(&d.scheduled),
+		Executed:  atomic.LoadUint64(&d.executed),
+		Failed:    atomic.LoadUint64(&d.failed),
+		Canceled:  atomic.LoadUint64(&d.canceled),
+		Pending:   pending,
+	}
+}
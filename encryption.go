@@ -0,0 +1,253 @@
+package relevantcache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Encryption algorithms
+const (
+	encryptionAESGCM = byte(1)
+)
+
+// Size of plain data which is sealed at once. Encrypted data is a sequence of segments,
+// so that large data can be encrypted and decrypted as stream.
+const encryptionSegmentSize = 64 * 1024
+
+// Keyring holds data keys to encrypt record data.
+// Data is encrypted by the current key, and any key in the keyring can decrypt data which is encrypted by it,
+// so keep old keys in the keyring until all records are rewritten on key rotation.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// Create keyring with AES keys. Each key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+// currentID is the ID of the key which is used to encrypt data.
+func NewKeyring(currentID string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current key %q is not found in keys", currentID)
+	}
+	k := &Keyring{
+		current: currentID,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key id must be 1 to 255 bytes: %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", id, err.Error())
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// Get ID of the key which is used to encrypt data
+func (k *Keyring) CurrentID() string {
+	return k.current
+}
+
+// Encryption section is [algorithm][segment size (uvarint)][key id]
+func encodeEncryptionSection(algo byte, segmentSize int, keyID string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(algo)
+	writeUvarint(buf, uint64(segmentSize))
+	buf.WriteString(keyID)
+	return buf.Bytes()
+}
+
+func decodeEncryptionSection(s []byte) (byte, int, string, error) {
+	if len(s) < 2 || s[0] != encryptionAESGCM {
+		return 0, 0, "", fmt.Errorf("unsupported encryption section")
+	}
+	size, p, err := readUvarint(s, 1)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if size == 0 || size > maxStreamHeaderFieldSize {
+		return 0, 0, "", fmt.Errorf("invalid encryption segment size: %d", size)
+	}
+	return s[0], int(size), string(s[p:]), nil
+}
+
+// Encrypt data of the record by the current key. key is bound to encrypted data
+func (o *recordOptions) encrypt(key string, r *record) error {
+	sr := o.sealReader(key, r, bytes.NewReader(r.data))
+	data, err := ioutil.ReadAll(sr)
+	if err != nil {
+		return err
+	}
+	r.data = data
+	return nil
+}
+
+// Wrap src to encrypt as stream, and set encryption section to the record
+func (o *recordOptions) sealReader(key string, r *record, src io.Reader) io.Reader {
+	r.setSection(flagEncryption, encodeEncryptionSection(encryptionAESGCM, encryptionSegmentSize, o.keyring.current))
+	return &sealReader{
+		aead: o.keyring.aeads[o.keyring.current],
+		aad:  []byte(key),
+		src:  bufio.NewReader(src),
+		size: encryptionSegmentSize,
+	}
+}
+
+// Wrap src to decrypt as stream if the record is encrypted.
+// Data which is failed to authenticate is reported as *CorruptRecordError
+func (o *recordOptions) openReader(key string, r *record, src io.Reader) (io.Reader, error) {
+	s := r.section(flagEncryption)
+	if s == nil {
+		return src, nil
+	}
+	_, size, keyID, err := decodeEncryptionSection(s)
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	}
+	if o.keyring == nil {
+		return nil, fmt.Errorf("record %s is encrypted but keyring is not configured", key)
+	}
+	aead, ok := o.keyring.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("record %s is encrypted by unknown key %q", key, keyID)
+	}
+	return &openReader{
+		key:  key,
+		aead: aead,
+		aad:  []byte(key),
+		src:  bufio.NewReader(src),
+		size: size + aead.NonceSize() + aead.Overhead(),
+	}, nil
+}
+
+// Additional data of the segment. Segment index and last flag prevent reordering and truncation
+func segmentAAD(aad []byte, index uint64, last bool) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(aad)+binary.MaxVarintLen64+1))
+	buf.Write(aad)
+	writeUvarint(buf, index)
+	if last {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// Reader which encrypts plain data as [nonce][sealed segment]...
+type sealReader struct {
+	aead  cipher.AEAD
+	aad   []byte
+	src   *bufio.Reader
+	size  int
+	index uint64
+	buf   []byte
+	done  bool
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *sealReader) next() error {
+	plain := make([]byte, s.size)
+	n, err := io.ReadFull(s.src, plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// Empty data is sealed as single empty segment, so that encrypted data always has the last segment
+	last := err != nil
+	if !last {
+		if _, err := s.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	s.buf = s.aead.Seal(nonce, nonce, plain[:n], segmentAAD(s.aad, s.index, last))
+	s.index++
+	s.done = last
+	return nil
+}
+
+// Reader which decrypts data which is encrypted by sealReader
+type openReader struct {
+	key   string
+	aead  cipher.AEAD
+	aad   []byte
+	src   *bufio.Reader
+	size  int
+	index uint64
+	buf   []byte
+	done  bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	segment := make([]byte, o.size)
+	n, err := io.ReadFull(o.src, segment)
+	if err == io.EOF {
+		return corruptRecord(o.key, fmt.Errorf("encrypted data is truncated"))
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := o.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	ns := o.aead.NonceSize()
+	if n < ns {
+		return corruptRecord(o.key, fmt.Errorf("encrypted segment is too short: %d bytes", n))
+	}
+	plain, err := o.aead.Open(nil, segment[:ns], segment[ns:n], segmentAAD(o.aad, o.index, last))
+	if err != nil {
+		return corruptRecord(o.key, fmt.Errorf("failed to decrypt segment %d: %s", o.index, err.Error()))
+	}
+	o.buf = plain
+	o.index++
+	o.done = last
+	return nil
+}
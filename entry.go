@@ -0,0 +1,116 @@
+package relevantcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Entry is a cache data with metadata which is stored in the record header
+type Entry struct {
+	Key          string
+	Value        []byte
+	RelevantKeys []string
+	DependsOn    []string
+	CreatedAt    time.Time // zero if value is set without *Item
+	Version      int64
+	Tags         []string
+	Origin       string
+}
+
+// Metadata of the item which is stored in the meta section
+type itemMeta struct {
+	createdAt time.Time
+	version   int64
+	tags      []string
+	origin    string
+}
+
+// Encode metadata as [created at unix nano (varint)][version (varint)][origin length (uvarint)][origin][tags as key list]
+func encodeItemMeta(m itemMeta) []byte {
+	buf := new(bytes.Buffer)
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], m.createdAt.UnixNano())])
+	buf.Write(b[:binary.PutVarint(b[:], m.version)])
+	writeUvarint(buf, uint64(len(m.origin)))
+	buf.WriteString(m.origin)
+	buf.Write(encodeKeyList(m.tags))
+	return buf.Bytes()
+}
+
+func decodeItemMeta(s []byte) (itemMeta, error) {
+	m := itemMeta{}
+	createdAt, n := binary.Varint(s)
+	if n <= 0 {
+		return m, fmt.Errorf("invalid created at in meta section")
+	}
+	p := n
+	version, n := binary.Varint(s[p:])
+	if n <= 0 {
+		return m, fmt.Errorf("invalid version in meta section")
+	}
+	p += n
+	origin, p, err := readChunk(s, p)
+	if err != nil {
+		return m, err
+	}
+	tags, err := decodeKeyList(s[p:])
+	if err != nil {
+		return m, err
+	}
+	m.createdAt = time.Unix(0, createdAt)
+	m.version = version
+	m.origin = string(origin)
+	if len(tags) > 0 {
+		m.tags = tags
+	}
+	return m, nil
+}
+
+// Get tags in metadata of the record, broken metadata is treated as no tags
+func (r *record) tags() []string {
+	s := r.section(flagMeta)
+	if s == nil {
+		return nil
+	}
+	m, err := decodeItemMeta(s)
+	if err != nil {
+		return nil
+	}
+	return m.tags
+}
+
+// Make Entry from stored data
+func (o *recordOptions) entry(key string, dat []byte, fetch chunkFetcher) (*Entry, error) {
+	e := &Entry{
+		Key: key,
+	}
+	r, err := decodeRecord(dat)
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	} else if r == nil {
+		e.Value = dat
+		return e, nil
+	}
+	if e.Value, err = o.open(key, r, fetch); err != nil {
+		return nil, err
+	}
+	if e.RelevantKeys, err = r.relevantKeys(); err != nil {
+		return nil, corruptRecord(key, err)
+	}
+	if e.DependsOn, err = r.dependsKeys(); err != nil {
+		return nil, corruptRecord(key, err)
+	}
+	if s := r.section(flagMeta); s != nil {
+		m, err := decodeItemMeta(s)
+		if err != nil {
+			return nil, corruptRecord(key, err)
+		}
+		e.CreatedAt = m.createdAt
+		e.Version = m.version
+		e.Tags = m.tags
+		e.Origin = m.origin
+	}
+	return e, nil
+}
@@ -0,0 +1,96 @@
+package relevantcache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorruptRecord is reported when stored record is broken, e.g. truncated, checksum mismatch.
+// Returned error is *CorruptRecordError, compare with errors.Is(err, ErrCorruptRecord)
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// Error which describes corrupt record
+type CorruptRecordError struct {
+	Key    string
+	Reason error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("%s for key %s: %s", ErrCorruptRecord.Error(), e.Key, e.Reason.Error())
+}
+
+func (e *CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Reason
+}
+
+func corruptRecord(key string, reason error) error {
+	return &CorruptRecordError{
+		Key:    key,
+		Reason: reason,
+	}
+}
+
+func corruptRecordOrNil(key string, reason error) error {
+	if reason == nil {
+		return nil
+	}
+	return corruptRecord(key, reason)
+}
+
+// Report whether err is caused by corrupt record
+func IsCorruptRecord(err error) bool {
+	_, ok := err.(*CorruptRecordError)
+	return ok
+}
+
+// ErrRelevanceDepthExceeded is reported when relevant keys or dependents are nested deeper than max relevance depth.
+// Returned error is *RelevanceDepthError, compare with errors.Is(err, ErrRelevanceDepthExceeded)
+var ErrRelevanceDepthExceeded = errors.New("relevance depth exceeded")
+
+// Error which describes the key whose relations are not followed
+type RelevanceDepthError struct {
+	Key   string
+	Depth int
+	// Keys from the root to Key
+	Path []string
+}
+
+func (e *RelevanceDepthError) Error() string {
+	return fmt.Sprintf("%s for key %s: max depth is %d", ErrRelevanceDepthExceeded.Error(), e.Key, e.Depth)
+}
+
+func (e *RelevanceDepthError) Is(target error) bool {
+	return target == ErrRelevanceDepthExceeded
+}
+
+// ErrWildcardBudgetExceeded is reported when expanding a relevant key with wildcard is stopped by WildcardBudget,
+// so keys which match the pattern might remain. Returned error is *WildcardBudgetError,
+// compare with errors.Is(err, ErrWildcardBudgetExceeded)
+var ErrWildcardBudgetExceeded = errors.New("wildcard budget exceeded")
+
+// Error which describes the pattern whose expansion is stopped
+type WildcardBudgetError struct {
+	Pattern string
+	Limit   WildcardLimit
+	// Count of keys which are matched before stopped
+	Matched int
+}
+
+func (e *WildcardBudgetError) Error() string {
+	return fmt.Sprintf("%s for pattern %s: stopped by %s after %d matches", ErrWildcardBudgetExceeded.Error(), e.Pattern, e.Limit, e.Matched)
+}
+
+func (e *WildcardBudgetError) Is(target error) bool {
+	return target == ErrWildcardBudgetExceeded
+}
+
+// ErrReservedHashField is returned when the field which holds relations of hash is accessed by HSet or HGet
+var ErrReservedHashField = errors.New("hash field is reserved")
+
+// ErrKeyspaceNotificationsDisabled is returned by NewRedisCache with expiry cascade
+// when notify-keyspace-events of the server doesn't include expired events of keyevent notifications ("E" and "x" or "A")
+var ErrKeyspaceNotificationsDisabled = errors.New("keyspace notifications for expired events are disabled")
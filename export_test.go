@@ -1,6 +1,9 @@
 package relevantcache
 
 import (
+	"strings"
+	"time"
+
 	"github.com/go-redis/redis"
 )
 
@@ -9,9 +12,68 @@ func (r *RedisCache) Conn() *redis.Client {
 }
 
 func (r *RedisCache) FactoryRelevantKeys(key string) []string {
-	return r.factoryRelevantKeys(key)
+	keys, _ := r.factoryRelevantKeys(key, newWalkState(r.maxDepth, r.w))
+	return keys
 }
 
 func (m *MemoryCache) FactoryRelevantKeys(key string) []string {
-	return m.factoryRelevantKeys(key)
+	keys, _ := m.factoryRelevantKeys(key, strings.Contains(key, "*"), CascadeAction{}, newWalkState(m.maxDepth, m.w))
+	return keys
+}
+
+func EncodeRecord(keys string, data []byte) []byte {
+	return newRecord([]byte(keys), data).encode()
+}
+
+// Decode record into keys and data. Data without header is returned as it is
+func DecodeRecord(dat []byte) ([]byte, []byte, error) {
+	r, err := decodeRecord(dat)
+	if err != nil || r == nil {
+		return nil, dat, err
+	}
+	return r.keys, r.data, nil
+}
+
+func EncodeItemWithChecksum(item *Item) []byte {
+	o := newRecordOptions()
+	o.checksum = true
+	b, _, _ := o.encodeItem(item)
+	return b
+}
+
+func RawValue(m *MemoryCache, key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[key].data
+}
+
+func SetRawValue(m *MemoryCache, key string, dat []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = memoryCacheEntry{data: dat}
+}
+
+func DependentsCount(m *MemoryCache, parent string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.dependents[parent]; ok {
+		return len(d.keys)
+	}
+	return 0
+}
+
+func ExpireNow(m *MemoryCache, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := m.data[key]
+	entry.expiration = time.Now().Add(-time.Second)
+	m.data[key] = entry
+}
+
+func GlobMatch(pattern, key string) bool {
+	return globMatch(pattern, key)
+}
+
+func ExpiredEventsEnabled(flags string) bool {
+	return expiredEventsEnabled(flags)
 }
@@ -0,0 +1,87 @@
+package relevantcache
+
+// Report whether key matches the glob pattern with the same semantics as redis KEYS and SCAN MATCH.
+// Pattern is matched against the whole key byte by byte. '*' matches any sequence, '?' matches any byte,
+// "[abc]" matches one of bytes in brackets ("[^abc]" negates, "[a-z]" is a range) and backslash escapes the next byte.
+// Like redis, unclosed bracket is closed at the end of pattern, and empty key never matches.
+func globMatch(pattern, key string) bool {
+	for len(pattern) > 0 && len(key) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for ; len(key) > 0; key = key[1:] {
+				if globMatch(pattern[1:], key) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			key = key[1:]
+		case '[':
+			end, ok := matchClass(pattern, key[0])
+			if !ok {
+				return false
+			}
+			pattern = pattern[end:]
+			key = key[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+		if len(key) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+		}
+	}
+	return len(pattern) == 0 && len(key) == 0
+}
+
+// Match c against the class which starts with '[' at pattern[0].
+// Returns index of the last byte of the class, which is ']' or the last byte of unclosed pattern.
+func matchClass(pattern string, c byte) (int, bool) {
+	p := 1
+	not := p < len(pattern) && pattern[p] == '^'
+	if not {
+		p++
+	}
+	match := false
+	for ; ; p++ {
+		if p >= len(pattern) {
+			p--
+			break
+		} else if pattern[p] == '\\' && len(pattern)-p >= 2 {
+			p++
+			if pattern[p] == c {
+				match = true
+			}
+		} else if pattern[p] == ']' {
+			break
+		} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+			start, end := pattern[p], pattern[p+2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				match = true
+			}
+			p += 2
+		} else if pattern[p] == c {
+			match = true
+		}
+	}
+	return p, match != not
+}
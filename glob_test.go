@@ -0,0 +1,114 @@
+package relevantcache_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	rc "github.com/ysugimoto/relevantcache"
+)
+
+var globCases = []struct {
+	pattern string
+	key     string
+	match   bool
+}{
+	{"user_1*", "user_1", true},
+	{"user_1*", "user_12", true},
+	{"user_1*", "xuser_1", false},
+	{"user.1*", "user_1", false},
+	{"user_?", "user_1", true},
+	{"user_?", "user_12", false},
+	{"user_[12]", "user_2", true},
+	{"user_[12]", "user_3", false},
+	{"user_[^12]", "user_3", true},
+	{"user_[^12]", "user_1", false},
+	{"user_[0-9]", "user_5", true},
+	{"user_[9-0]", "user_5", true},
+	{"user_[a-z]", "user_5", false},
+	{"user_[\\]]", "user_]", true},
+	{"user_\\*", "user_*", true},
+	{"user_\\*", "user_1", false},
+	{"user_\\?", "user_1", false},
+	{"*_1", "user_1", true},
+	{"*_1", "user_12", false},
+	{"user_**", "user_", true},
+	{"*", "", false},
+	{"user_[12", "user_1", true},
+	{"user\\", "user\\", true},
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range globCases {
+		assert.Equal(t, c.match, rc.GlobMatch(c.pattern, c.key), "%s against %s", c.pattern, c.key)
+	}
+}
+
+// Both backends should invalidate the same keys by relevant keys with glob pattern
+func TestGlobMatchInvalidatesSameKeys(t *testing.T) {
+	r, _ := rc.NewRedisCache(redisUrl)
+	defer r.Close()
+	m := rc.NewMemoryCache()
+	defer m.Close()
+
+	keys := []string{"glob_user_1", "glob_user_12", "glob_user_2", "glob_user_a", "glob_user.1", "xglob_user_1", "glob_user_*"}
+	items := make([]interface{}, len(keys))
+	for i, k := range keys {
+		items[i] = k
+	}
+	for _, pattern := range []string{"glob_user_1*", "glob_user_?*", "glob_user_[12]*", "glob_user_[^0-9]*", "glob_user_\\*", "glob_user.*"} {
+		remains := [][]string{}
+		for _, c := range []rc.Cache{r, m} {
+			for _, k := range keys {
+				assert.NoError(t, c.Set(k, "v"))
+			}
+			assert.NoError(t, c.Set(rc.NewItem("glob_root").Value("root").RelevantTo(pattern)))
+			assert.NoError(t, c.Del("glob_root"))
+			remain := []string{}
+			for _, k := range keys {
+				if _, err := c.Get(k); err == nil {
+					remain = append(remain, k)
+				}
+			}
+			remains = append(remains, remain)
+			assert.NoError(t, c.Del(items...))
+		}
+		assert.Equal(t, remains[0], remains[1], pattern)
+	}
+}
+
+// Keys matched by glob pattern should cascade to their relations, dependents and chunks on both backends
+func TestGlobMatchCascadesSameKeys(t *testing.T) {
+	r, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(10))
+	defer r.Close()
+	m := rc.NewMemoryCache(rc.WithSplitBufferSize(10))
+	defer m.Close()
+
+	keys := []string{"cascade_a", "cascade_b_1", "cascade_c_1", "cascade_d_1", "cascade_b_1:chunk:0", "cascade_b_1:chunk:1", "cascade_b_1:chunk:2"}
+	exists := map[rc.Cache]func(k string) bool{
+		r: func(k string) bool { return r.Conn().Exists(k).Val() == 1 },
+		m: func(k string) bool { return rc.RawValue(m, k) != nil },
+	}
+	for _, root := range []*rc.Item{
+		rc.NewItem("cascade_a").Value("a").RelevantAll("cascade_b"),
+		rc.NewItem("cascade_a").Value("a").RelevantMatch("cascade_b_?"),
+	} {
+		remains := [][]string{}
+		for _, c := range []rc.Cache{r, m} {
+			assert.NoError(t, c.Set(rc.NewItem("cascade_c", 1).Value("c")))
+			assert.NoError(t, c.Set(rc.NewItem("cascade_d", 1).Value("d").DependsOn("cascade_b", 1)))
+			assert.NoError(t, c.Set(rc.NewItem("cascade_b", 1).Value("value which is split into chunks").RelevantTo("cascade_c", 1)))
+			assert.NoError(t, c.Set(root))
+			assert.True(t, exists[c]("cascade_b_1:chunk:0"))
+			assert.NoError(t, c.Del("cascade_a"))
+			remain := []string{}
+			for _, k := range keys {
+				if exists[c](k) {
+					remain = append(remain, k)
+				}
+			}
+			remains = append(remains, remain)
+		}
+		assert.Equal(t, []string{}, remains[0])
+		assert.Equal(t, remains[0], remains[1])
+	}
+}
@@ -4,6 +4,8 @@ go 1.12
 
 require (
 	github.com/go-redis/redis v6.15.2+incompatible
+	github.com/golang/protobuf v1.5.4
+	github.com/golang/snappy v1.0.0
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/stretchr/testify v1.4.0
 )
@@ -0,0 +1,200 @@
+package relevantcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Output format of ExportGraph
+type GraphFormat int
+
+const (
+	// Graphviz DOT
+	GraphDOT GraphFormat = iota + 1
+	// JSON object of nodes and edges
+	GraphJSON
+)
+
+// Key in the relevance graph
+type GraphNode struct {
+	Key string `json:"key"`
+	// TTL in milliseconds, -1 if the key never expires
+	TTL int64 `json:"ttl"`
+	// Size of stored value in bytes, 0 if the value isn't a string on redis
+	Size int `json:"size"`
+	// Whether the record header is broken
+	Corrupt bool `json:"corrupt,omitempty"`
+}
+
+// Edge in the relevance graph, To is deleted when From is deleted
+type GraphEdge struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Kind     EdgeKind `json:"kind"`
+	Wildcard bool     `json:"wildcard,omitempty"`
+	// Relevant key which To is matched by, only for wildcard edges
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Relevance graph of all keys in the cache
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+func (k EdgeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *EdgeKind) UnmarshalText(text []byte) error {
+	for _, v := range []EdgeKind{EdgeRelevant, EdgeDependent, EdgeChunk, EdgeIndex} {
+		if v.String() == string(text) {
+			*k = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown edge kind: %s", text)
+}
+
+// Record which is scanned to build graph
+type graphRecord struct {
+	key  string
+	ttl  int64
+	size int
+	// Decoded record header, nil if the value has no header
+	header *record
+	// Whether the record header is broken
+	corrupt bool
+}
+
+// Build graph from scanned records. Dependents and tag index keys are not included because they are internal.
+// Relevant keys with wildcard are expanded within budget against keys which share the literal prefix of the pattern.
+func buildGraph(records []graphRecord, budget WildcardBudget) *Graph {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+	g := &Graph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	keys := make([]string, 0, len(records))
+	for _, rec := range records {
+		if !isIndexKey(rec.key) {
+			keys = append(keys, rec.key)
+		}
+	}
+	for _, rec := range records {
+		if isIndexKey(rec.key) {
+			continue
+		}
+		node := GraphNode{
+			Key:     rec.key,
+			TTL:     rec.ttl,
+			Size:    rec.size,
+			Corrupt: rec.corrupt,
+		}
+		if rec.header != nil {
+			edges, err := recordEdges(rec.key, rec.header, keys, budget)
+			if err != nil {
+				node.Corrupt = true
+			}
+			g.Edges = append(g.Edges, edges...)
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+	return g
+}
+
+// Decode edges from the record header. Sorted keys are used to expand relevant keys with wildcard
+func recordEdges(key string, r *record, keys []string, budget WildcardBudget) ([]GraphEdge, error) {
+	edges := []GraphEdge{}
+	relevantKeys, err := r.relevantKeys()
+	if err != nil {
+		return edges, err
+	}
+	for _, k := range relevantKeys {
+		if !r.isWildcard(k) {
+			edges = append(edges, GraphEdge{From: key, To: k, Kind: EdgeRelevant})
+			continue
+		}
+		for _, v := range expandGraphPattern(k, keys, budget) {
+			edges = append(edges, GraphEdge{From: key, To: v, Kind: EdgeRelevant, Wildcard: true, Pattern: k})
+		}
+	}
+	chunkKeys, err := r.chunkKeys()
+	if err != nil {
+		return edges, err
+	}
+	for _, k := range chunkKeys {
+		edges = append(edges, GraphEdge{From: key, To: k, Kind: EdgeChunk})
+	}
+	parents, err := r.dependsKeys()
+	if err != nil {
+		return edges, err
+	}
+	for _, p := range parents {
+		edges = append(edges, GraphEdge{From: p, To: key, Kind: EdgeDependent})
+	}
+	return edges, nil
+}
+
+// Match pattern against sorted keys within budget. Only keys which start with the literal prefix of pattern are scanned
+func expandGraphPattern(pattern string, keys []string, budget WildcardBudget) []string {
+	s := newWildcardScanner("", pattern, budget)
+	prefix := globPrefix(pattern)
+	for i := sort.SearchStrings(keys, prefix); i < len(keys) && strings.HasPrefix(keys[i], prefix); i++ {
+		if !s.next() {
+			break
+		}
+		s.add(1)
+		if globMatch(pattern, keys[i]) {
+			s.add(0, keys[i])
+		}
+	}
+	return s.e.Matched
+}
+
+// Write graph in the format
+func writeGraph(w io.Writer, format GraphFormat, g *Graph) error {
+	switch format {
+	case GraphJSON:
+		return json.NewEncoder(w).Encode(g)
+	case GraphDOT:
+		return writeDOT(w, g)
+	default:
+		return fmt.Errorf("unsupported graph format: %d", format)
+	}
+}
+
+func writeDOT(w io.Writer, g *Graph) error {
+	var b strings.Builder
+	b.WriteString("digraph relevantcache {\n")
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s\\nttl=%dms size=%d", dotEscape(n.Key), n.TTL, n.Size)
+		if n.TTL < 0 {
+			label = fmt.Sprintf("%s\\nttl=none size=%d", dotEscape(n.Key), n.Size)
+		}
+		attrs := fmt.Sprintf("label=\"%s\"", label)
+		if n.Corrupt {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(&b, "  \"%s\" [%s];\n", dotEscape(n.Key), attrs)
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=\"%s\"", e.Kind)
+		if e.Wildcard {
+			attrs = fmt.Sprintf("label=\"%s %s\", style=dashed", e.Kind, dotEscape(e.Pattern))
+		}
+		fmt.Fprintf(&b, "  \"%s\" -> \"%s\" [%s];\n", dotEscape(e.From), dotEscape(e.To), attrs)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
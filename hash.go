@@ -0,0 +1,22 @@
+package relevantcache
+
+import (
+	"strings"
+)
+
+// Reserved field of hash which holds relations of the hash as record header without data,
+// so that Del of the hash cascades like a string record. The field is hidden from HGet and HLen.
+const hashMetaField = "__rc:meta"
+
+// Get relations of item to store in hash, or nil if item has no relations
+func hashMeta(item *Item, origin string) []byte {
+	if len(item.relevant) == 0 && len(item.depends) == 0 && len(item.tags) == 0 && !item.cascade.isSet() {
+		return nil
+	}
+	return item.header(origin).encode()
+}
+
+// Report whether err is returned for the command against a key holding the wrong kind of value
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
@@ -3,6 +3,7 @@ package relevantcache
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // Relevant item struct
@@ -10,8 +11,17 @@ import (
 type Item struct {
 	key      string
 	relevant []*Item
+	depends  []*Item
 	ttl      int64
 	value    interface{}
+	codec    Codec
+	version  int64
+	tags     []string
+	origin   string
+	// Action on cascading deletion. For relevant items, it's the action which is applied to relevant key
+	cascade CascadeAction
+	// Whether relevant item is a wildcard pattern
+	wildcard bool
 }
 
 func KeyGen(args ...interface{}) string {
@@ -30,19 +40,61 @@ func NewItem(args ...interface{}) *Item {
 	}
 }
 
-// Declare relevant cache keys
+// Declare relevant cache keys. Key which contains asterisk sign is treated as wildcard pattern
 func (i *Item) RelevantTo(args ...interface{}) *Item {
-	i.relevant = append(i.relevant, NewItem(args...))
-	return i
+	return i.relevantTo(NewItem(args...))
 }
 
 // Declare relevant cache keys with asterisk sign suffix
 func (i *Item) RelevantAll(args ...interface{}) *Item {
 	args = append(args, "*")
+	r := NewItem(args...)
+	r.wildcard = true
+	i.relevant = append(i.relevant, r)
+	return i
+}
+
+// Declare relevant cache key which is matched exactly even if it contains asterisk sign
+func (i *Item) RelevantExact(args ...interface{}) *Item {
 	i.relevant = append(i.relevant, NewItem(args...))
 	return i
 }
 
+// Declare relevant cache keys by glob pattern, which is matched with the same syntax as redis SCAN
+func (i *Item) RelevantMatch(pattern string) *Item {
+	r := &Item{key: pattern, wildcard: true}
+	i.relevant = append(i.relevant, r)
+	return i
+}
+
+func (i *Item) relevantTo(r *Item) *Item {
+	r.wildcard = strings.Contains(r.key, "*")
+	i.relevant = append(i.relevant, r)
+	return i
+}
+
+// Declare relevant cache keys with the action which is applied to them on cascading deletion.
+// The action takes precedence over the action of the relevant record.
+func (i *Item) CascadeTo(action CascadeAction, args ...interface{}) *Item {
+	r := NewItem(args...)
+	r.cascade = action
+	return i.relevantTo(r)
+}
+
+// Set action which is applied to this item when it's reached by cascading deletion from relevant caches
+// or the keys which this item depends on. Default is CascadeDelete.
+func (i *Item) OnCascade(action CascadeAction) *Item {
+	i.cascade = action
+	return i
+}
+
+// Declare cache keys which this item depends on.
+// When one of them is deleted, this item is deleted as well.
+func (i *Item) DependsOn(args ...interface{}) *Item {
+	i.depends = append(i.depends, NewItem(args...))
+	return i
+}
+
 // Set TTL
 func (i *Item) Ttl(ttl int64) *Item {
 	i.ttl = ttl
@@ -55,6 +107,30 @@ func (i *Item) Value(val interface{}) *Item {
 	return i
 }
 
+// Set Codec for this item. If not set, cache codec is used
+func (i *Item) Codec(c Codec) *Item {
+	i.codec = c
+	return i
+}
+
+// Set user-supplied version which is stored in metadata
+func (i *Item) Version(v int64) *Item {
+	i.version = v
+	return i
+}
+
+// Add tags which are stored in metadata. Tagged items can be deleted together by InvalidateTags
+func (i *Item) Tags(tags ...string) *Item {
+	i.tags = append(i.tags, tags...)
+	return i
+}
+
+// Set name of the service which writes this item. If not set, cache origin is used
+func (i *Item) Origin(name string) *Item {
+	i.origin = name
+	return i
+}
+
 // Get cache key
 func (i *Item) cacheKey() string {
 	return i.key
@@ -69,34 +145,78 @@ func (i *Item) getRelevaneKeys() []string {
 	return relevantKeys
 }
 
-// Generate and get metadata
-func (i *Item) encode() []byte {
-	return encodeMeta(
-		strings.Join(i.getRelevaneKeys(), keyDelimiter),
-		i.value,
-	)
+// List cache keys which this item depends on
+func (i *Item) getDependsKeys() []string {
+	dependsKeys := make([]string, len(i.depends))
+	for j, v := range i.depends {
+		dependsKeys[j] = v.cacheKey()
+	}
+	return dependsKeys
 }
 
-// Codec: encode metadata and actual data to byte slice for storing
-func encodeMeta(keyStr string, value interface{}) []byte {
-	keys := []byte(keyStr)
-	m := []byte{signatureSign, nb}
-	size := len(keys)
-	m = append(m, byte(size<<8), byte(size&0xFF))
-	m = append(m, keys...)
-	m = append(m, []byte(fmt.Sprint(value))...)
-	return m
+// Generate record which has metadata. codec and origin are used when item doesn't have own ones
+func (i *Item) toRecord(codec Codec, origin string) (*record, error) {
+	if i.codec != nil {
+		codec = i.codec
+	}
+	data, err := codec.Marshal(i.value)
+	if err != nil {
+		return nil, err
+	}
+	r := i.header(origin)
+	r.data = data
+	if codec.ID() != codecIDRaw {
+		r.setSection(flagCodec, []byte{codec.ID()})
+	}
+	return r, nil
 }
 
-// Codec: decode from stored data to metadata and actual data
-func decodeMeta(dat []byte) ([]byte, []byte) {
-	if len(dat) <= 2 {
-		return nil, dat
-	} else if dat[0] != signatureSign || dat[1] != nb {
-		return nil, dat
+// Generate record which has only metadata
+func (i *Item) header(origin string) *record {
+	r := newRecord(nil, nil)
+	if len(i.relevant) > 0 {
+		r.setRelevantKeys(i.getRelevaneKeys())
+	}
+	// Wildcard section is needed only when any key isn't distinguished by asterisk sign
+	wildcards := []string{}
+	explicit := false
+	for _, v := range i.relevant {
+		if v.wildcard {
+			wildcards = append(wildcards, v.cacheKey())
+		}
+		if v.wildcard != strings.Contains(v.cacheKey(), "*") {
+			explicit = true
+		}
+	}
+	if explicit {
+		r.setSection(flagWildcard, encodeKeyList(wildcards))
+	}
+	if len(i.depends) > 0 {
+		r.setSection(flagDepends, encodeKeyList(i.getDependsKeys()))
+	}
+	actions := cascadeActions{
+		self:  i.cascade,
+		edges: map[string]CascadeAction{},
+	}
+	for _, v := range i.relevant {
+		if v.cascade.isSet() {
+			actions.edges[v.cacheKey()] = v.cascade
+		}
+	}
+	if actions.self.isSet() || len(actions.edges) > 0 {
+		r.setSection(flagCascade, encodeCascadeSection(actions))
+	}
+	if i.origin != "" {
+		origin = i.origin
 	}
-	size := int16((dat[2] << 8) | dat[3])
-	return dat[4 : 4+size], dat[4+size:]
+	// Meta section is always written so that every record of item has created time
+	r.setSection(flagMeta, encodeItemMeta(itemMeta{
+		createdAt: time.Now(),
+		version:   i.version,
+		tags:      i.tags,
+		origin:    origin,
+	}))
+	return r
 }
 
 // Consider type and return as type conversion-ed value
@@ -1,10 +1,12 @@
 package relevantcache
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"regexp"
+	"io/ioutil"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,6 +19,20 @@ import (
 type memoryCacheEntry struct {
 	data       []byte
 	expiration time.Time
+	// Whether data is JSON-encoded hash which is set by HSet
+	hash bool
+}
+
+// Get record to walk relations. Hash returns the reserved field, which is empty if the hash has no relations
+func (m memoryCacheEntry) record() []byte {
+	if !m.hash {
+		return m.data
+	}
+	var d map[string][]byte
+	if err := json.Unmarshal(m.data, &d); err != nil || d[hashMetaField] == nil {
+		return []byte{}
+	}
+	return d[hashMetaField]
 }
 
 func (m memoryCacheEntry) Expired() bool {
@@ -26,10 +42,37 @@ func (m memoryCacheEntry) Expired() bool {
 	return time.Now().After(m.expiration)
 }
 
+// Reverse dependency index of a parent key, or tag index of a tag
+type memoryDependents struct {
+	keys map[string]struct{}
+	// Count of keys after last sweep. Expired keys are swept when count is doubled
+	swept int
+}
+
 type MemoryCache struct {
-	data map[string]memoryCacheEntry
-	mu   sync.Mutex
-	w    io.Writer
+	data       map[string]memoryCacheEntry
+	dependents map[string]*memoryDependents
+	tags       map[string]*memoryDependents
+	mu         sync.Mutex
+	w          io.Writer
+	opts       *recordOptions
+	maxDepth   int
+	budget     WildcardBudget
+	// Second deletion of Del, nil if double delete is disabled
+	double *doubleDeleter
+
+	// Expired records which are deleted lazily, janitor cascades deletion from them
+	expiryCascade bool
+	expired       map[string][]byte
+	stop          chan struct{}
+	closeOnce     sync.Once
+	wg            sync.WaitGroup
+
+	// Keys which are scheduled by DelAt, scheduler is started on first schedule
+	schedule     *scheduleHeap
+	scheduleMu   sync.Mutex
+	scheduleOnce sync.Once
+	scheduleWake chan struct{}
 }
 
 func (m *MemoryCache) Redis() *redis.Client {
@@ -38,25 +81,215 @@ func (m *MemoryCache) Redis() *redis.Client {
 
 func NewMemoryCache(opts ...option) *MemoryCache {
 	m := &MemoryCache{
-		data: make(map[string]memoryCacheEntry),
+		data:       make(map[string]memoryCacheEntry),
+		dependents: make(map[string]*memoryDependents),
+		tags:       make(map[string]*memoryDependents),
+		opts:       newRecordOptions(),
+		maxDepth:   defaultMaxRelevanceDepth,
+		expired:    make(map[string][]byte),
+		stop:       make(chan struct{}),
+
+		schedule:     newScheduleHeap(),
+		scheduleWake: make(chan struct{}, 1),
 	}
+	interval := defaultJanitorInterval
+	var doubleDelay time.Duration
 	for _, o := range opts {
 		switch o.name {
 		case optionNameDebugWriter:
 			m.w = o.value.(io.Writer)
+		case optionNameMaxRelevanceDepth:
+			m.maxDepth = o.value.(int)
+		case optionNameWildcardBudget:
+			m.budget = o.value.(WildcardBudget)
+		case optionNameDoubleDelete:
+			doubleDelay = o.value.(time.Duration)
+		case optionNameExpiryCascade:
+			m.expiryCascade = o.value.(bool)
+		case optionNameJanitorInterval:
+			interval = o.value.(time.Duration)
+		default:
+			m.opts.apply(o)
 		}
 	}
+	if doubleDelay > 0 {
+		m.double = newDoubleDeleter(doubleDelay, m.w, func(_ string, keys ...interface{}) error {
+			_, err := m.invalidate(nil, keys...)
+			return err
+		})
+	}
+	if m.expiryCascade {
+		m.wg.Add(1)
+		go m.janitor(interval)
+	}
 	return m
 }
 
+// Stop janitor, scheduler and double delete if running
 func (m *MemoryCache) Close() error {
+	m.double.close()
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	m.wg.Wait()
 	return nil
 }
 
+// Default interval of janitor which deletes expired records
+const defaultJanitorInterval = time.Second
+
+func (m *MemoryCache) janitor(interval time.Duration) {
+	defer m.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+			m.cascadeExpired()
+		}
+	}
+}
+
+// Schedule items to be deleted with relevant caches at t. Scheduling the same key again replaces the time
+func (m *MemoryCache) DelAt(t time.Time, items ...interface{}) error {
+	roots := m.rootKeys("SCHEDULE", items...)
+	if len(roots) == 0 {
+		return nil
+	}
+	debug(m.w, fmt.Sprintf("[SCHEDULE] delete %q at %s\n", roots, t.Format(time.RFC3339Nano)))
+	m.scheduleMu.Lock()
+	for _, k := range roots {
+		m.schedule.schedule(k, t)
+	}
+	m.scheduleMu.Unlock()
+
+	m.scheduleOnce.Do(func() {
+		m.wg.Add(1)
+		go m.scheduler()
+	})
+	select {
+	case m.scheduleWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Schedule items to be deleted with relevant caches after d
+func (m *MemoryCache) DelAfter(d time.Duration, items ...interface{}) error {
+	return m.DelAt(time.Now().Add(d), items...)
+}
+
+// Delete scheduled keys when they are due until Close. Timer is reset to the earliest key whenever keys are scheduled
+func (m *MemoryCache) scheduler() {
+	defer m.wg.Done()
+	for {
+		m.scheduleMu.Lock()
+		keys := m.schedule.due(time.Now())
+		next, ok := m.schedule.next()
+		m.scheduleMu.Unlock()
+
+		if len(keys) > 0 {
+			debug(m.w, fmt.Sprintf("[SCHEDULE] delete scheduled keys %q\n", keys))
+			items := make([]interface{}, len(keys))
+			for i, k := range keys {
+				items[i] = k
+			}
+			if err := m.Del(items...); err != nil {
+				debug(m.w, fmt.Sprintf("[SCHEDULE] %s\n", err.Error()))
+			}
+		}
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if ok {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		select {
+		case <-m.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-m.scheduleWake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Delete expired entry, mu must be locked by caller.
+// The record is kept for janitor to cascade deletion when expiry cascade is enabled.
+func (m *MemoryCache) dropExpired(key string, entry memoryCacheEntry) {
+	delete(m.data, key)
+	if m.expiryCascade {
+		m.expired[key] = entry.record()
+	}
+}
+
+// Delete expired records, and relevant caches and dependents of them as Del does
+func (m *MemoryCache) cascadeExpired() {
+	m.mu.Lock()
+	for k, entry := range m.data {
+		if entry.Expired() {
+			m.dropExpired(k, entry)
+		}
+	}
+	expired := m.expired
+	m.expired = make(map[string][]byte)
+	m.mu.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(expired))
+	for k := range expired {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w := newWalkState(m.maxDepth, m.w)
+	deleteKeys := []string{}
+	for _, k := range keys {
+		// Chunks expire with records, so they don't cascade by themselves
+		if isChunkKey(k) {
+			continue
+		}
+		debug(m.w, fmt.Sprintf("[EXPIRE] key is: %s\n", k))
+		// Key is set again after expired, so relations of the new record are kept
+		m.mu.Lock()
+		entry, ok := m.data[k]
+		m.mu.Unlock()
+		if ok && !entry.Expired() {
+			debug(m.w, fmt.Sprintf("[EXPIRE] %s is set again after expired. skipped\n", k))
+			continue
+		}
+		if !w.enter(k) {
+			continue
+		}
+		relevantKeys, err := m.walkKey(k, expired[k], CascadeAction{}, w)
+		w.leave()
+		if err != nil {
+			debug(m.w, fmt.Sprintf("[EXPIRE] %s\n", err.Error()))
+		}
+		debug(m.w, fmt.Sprintf("[EXPIRE] factory keys are: %q\n", relevantKeys))
+		deleteKeys = append(deleteKeys, relevantKeys...)
+	}
+	debug(m.w, fmt.Sprintf("[EXPIRE] delete relevant caches %q\n", deleteKeys))
+	m.deleteKeys("EXPIRE", deleteKeys, w, nil)
+}
+
 func (m *MemoryCache) Purge() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.data = make(map[string]memoryCacheEntry)
+	m.dependents = make(map[string]*memoryDependents)
+	m.tags = make(map[string]*memoryDependents)
+	m.expired = make(map[string][]byte)
 	return nil
 }
 
@@ -95,20 +328,168 @@ func (m *MemoryCache) Get(item interface{}) ([]byte, error) {
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	b, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := m.opts.payload(key, b, m.fetchChunks)
+	if err != nil {
+		m.dropCorruptRecord(key, b, err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// Get cache even if it's marked as stale by cascading deletion, so that it can be served while refreshing.
+// stale reports whether the cache is marked as stale.
+func (m *MemoryCache) GetStale(item interface{}) (data []byte, stale bool, err error) {
+	key, err := getKey(item)
+	if err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.lookup(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if data, err = m.opts.payload(key, b, m.fetchChunks); err != nil {
+		m.dropCorruptRecord(key, b, err)
+		return nil, false, err
+	}
+	return data, isStaleRecord(b), nil
+}
+
+// Get cache and unmarshal to dst with the codec which the cache is encoded by
+func (m *MemoryCache) GetValue(item interface{}, dst interface{}) error {
+	key, err := getKey(item)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.get(key)
+	if err != nil {
+		return err
+	}
+	if err := m.opts.unmarshal(key, b, dst, m.fetchChunks); err != nil {
+		m.dropCorruptRecord(key, b, err)
+		return err
+	}
+	return nil
+}
+
+// Get cache with metadata which is stored in the record header
+func (m *MemoryCache) GetWithMeta(item interface{}) (*Entry, error) {
+	key, err := getKey(item)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	e, err := m.opts.entry(key, b, m.fetchChunks)
+	if err != nil {
+		m.dropCorruptRecord(key, b, err)
+		return nil, err
+	}
+	return e, nil
+}
+
+// Get cache as stream. Record header is parsed incrementally as RedisCache does,
+// and chunks are read on demand. Checksum is verified when stream reaches EOF.
+func (m *MemoryCache) GetStream(item interface{}) (io.ReadCloser, error) {
+	key, err := getKey(item)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	b, err := m.get(key)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(bytes.NewReader(b))
+	r, err := decodeRecordHeader(br)
+	if err != nil {
+		err = corruptRecord(key, err)
+	} else if r == nil {
+		return ioutil.NopCloser(br), nil
+	} else if r.isStale() {
+		return nil, fmt.Errorf("record is stale for key: %s", key)
+	} else {
+		var rc io.ReadCloser
+		if rc, err = m.opts.openStream(key, r, br, m.fetchChunk); err == nil {
+			return rc, nil
+		}
+	}
+	m.mu.Lock()
+	m.dropCorruptRecord(key, b, err)
+	m.mu.Unlock()
+	return nil, err
+}
+
+// Get a chunk of split record
+func (m *MemoryCache) fetchChunk(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.data[key]; ok && !entry.Expired() {
+		return entry.data, nil
+	}
+	return nil, nil
+}
+
+// Get chunks of split record, mu must be locked by caller
+func (m *MemoryCache) fetchChunks(keys []string) ([][]byte, error) {
+	chunks := make([][]byte, len(keys))
+	for i, k := range keys {
+		if entry, ok := m.data[k]; ok && !entry.Expired() {
+			chunks[i] = entry.data
+		}
+	}
+	return chunks, nil
+}
+
+// Delete corrupt record if policy is CorruptRecordDelete, mu must be locked by caller
+func (m *MemoryCache) dropCorruptRecord(key string, dat []byte, err error) {
+	if !IsCorruptRecord(err) {
+		return
+	}
+	debug(m.w, fmt.Sprintf("[CORRUPT] %s\n", err.Error()))
+	for _, k := range m.opts.corruptKeys(key, dat) {
+		delete(m.data, k)
+	}
+}
+
+// Get stored record. Record which is marked as stale is treated as missing, mu must be locked by caller
+func (m *MemoryCache) get(key string) ([]byte, error) {
+	b, err := m.lookup(key)
+	if err == nil && isStaleRecord(b) {
+		return nil, fmt.Errorf("record is stale for key: %s", key)
+	}
+	return b, err
+}
+
+// Get stored record as it is, mu must be locked by caller
+func (m *MemoryCache) lookup(key string) ([]byte, error) {
 	entry, ok := m.data[key]
 	if !ok {
 		return nil, fmt.Errorf("record doesn't exist for key: %s", key)
 	} else if entry.Expired() {
-		delete(m.data, key)
+		m.dropExpired(key, entry)
 		return nil, fmt.Errorf("record has been expired for key: %s", key)
 	}
-	_, data := decodeMeta(entry.data)
-	return data, nil
+	return entry.data, nil
 }
 
 func (m *MemoryCache) Set(args ...interface{}) (err error) {
 	var key string
-	var value interface{}
+	var dat []byte
+	var chunks []chunk
+	var depends, tags []string
 	var ttl int
 
 	switch len(args) {
@@ -120,16 +501,24 @@ func (m *MemoryCache) Set(args ...interface{}) (err error) {
 			return fmt.Errorf("if and only one argument is supplied, it must be *Item")
 		}
 		key = item.cacheKey()
-		value = item.encode()
+		if dat, chunks, err = m.opts.encodeItem(item); err != nil {
+			return err
+		}
 		ttl = int(item.ttl)
+		depends = item.getDependsKeys()
+		tags = item.tags
 		debug(m.w, fmt.Sprintf("[SET] cahce key %s is relevant to %q\n", key, item.getRelevaneKeys()))
 	case 2:
 		key = args[0].(string)
-		value = args[1]
+		if dat, chunks, err = m.opts.encodeValue(key, args[1]); err != nil {
+			return err
+		}
 		ttl = 0
 	case 3:
 		key = args[0].(string)
-		value = args[1]
+		if dat, chunks, err = m.opts.encodeValue(key, args[1]); err != nil {
+			return err
+		}
 		ttl = args[2].(int)
 	}
 
@@ -137,57 +526,266 @@ func (m *MemoryCache) Set(args ...interface{}) (err error) {
 	if ttl > 0 {
 		expiration = time.Now().Add(time.Duration(ttl) * time.Second)
 	}
-	var dat []byte
-	switch t := value.(type) {
-	case string:
-		dat = []byte(t)
-	case []byte:
-		dat = t
-	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if old, ok := m.data[key]; ok {
+		for _, k := range staleChunkKeys(old.data, chunkKeyList(chunks)) {
+			delete(m.data, k)
+		}
+	}
+	for _, c := range chunks {
+		m.data[c.key] = memoryCacheEntry{
+			data:       c.data,
+			expiration: expiration,
+		}
+	}
 	m.data[key] = memoryCacheEntry{
 		data:       dat,
 		expiration: expiration,
 	}
+	m.indexDependent(key, depends)
+	m.indexTags(key, tags)
 	return nil
 }
 
-func (m *MemoryCache) Del(items ...interface{}) error {
-	deleteKeys := []string{}
+// Add key to reverse dependency index of parents, mu must be locked by caller
+func (m *MemoryCache) indexDependent(key string, parents []string) {
+	m.addIndex(m.dependents, key, parents)
+}
 
-	for _, v := range items {
-		key, err := getKey(v)
-		if err != nil {
-			debug(m.w, fmt.Sprintf("[DEL] invalid keys:%v,  %s\n", v, err.Error()))
+// Add key to tag index of tags, mu must be locked by caller
+func (m *MemoryCache) indexTags(key string, tags []string) {
+	m.addIndex(m.tags, key, tags)
+}
+
+func (m *MemoryCache) addIndex(index map[string]*memoryDependents, key string, names []string) {
+	for _, p := range names {
+		d, ok := index[p]
+		if !ok {
+			d = &memoryDependents{
+				keys: map[string]struct{}{},
+			}
+			index[p] = d
+		}
+		d.keys[key] = struct{}{}
+		if len(d.keys) < 16 || len(d.keys) < d.swept*2 {
 			continue
 		}
-		debug(m.w, fmt.Sprintf("[DEL] key is: %s\n", key))
+		for k := range d.keys {
+			if entry, ok := m.data[k]; !ok || entry.Expired() {
+				delete(d.keys, k)
+			}
+		}
+		d.swept = len(d.keys)
+	}
+}
 
-		keys := m.factoryRelevantKeys(key)
-		debug(m.w, fmt.Sprintf("[DEL] factory keys are: %q\n", keys))
+// Set cache from stream. Data is split into chunks as RedisCache does,
+// and all of chunks and the record are stored at once after reading stream.
+func (m *MemoryCache) SetStream(item *Item, src io.Reader) error {
+	key := item.cacheKey()
+	var chunks []chunk
+	r, keys, err := m.opts.writeStream(item, src, func(c chunk) error {
+		chunks = append(chunks, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	debug(m.w, fmt.Sprintf("[SET] cahce key %s is relevant to %q, streamed into %d chunks\n", key, item.getRelevaneKeys(), len(keys)))
 
-		deleteKeys = append(deleteKeys, keys...)
+	var expiration time.Time
+	if item.ttl > 0 {
+		expiration = time.Now().Add(time.Duration(item.ttl) * time.Second)
 	}
 
-	if len(deleteKeys) == 0 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.data[key]; ok {
+		for _, k := range staleChunkKeys(old.data, keys) {
+			delete(m.data, k)
+		}
+	}
+	for _, c := range chunks {
+		m.data[c.key] = memoryCacheEntry{
+			data:       c.data,
+			expiration: expiration,
+		}
+	}
+	m.data[key] = memoryCacheEntry{
+		data:       r.encode(),
+		expiration: expiration,
+	}
+	m.indexDependent(key, item.getDependsKeys())
+	m.indexTags(key, item.tags)
+	return nil
+}
+
+// Delete caches and relevant caches.
+// If corrupt record is found on resolving relevant keys, it's deleted and *CorruptRecordError is returned.
+func (m *MemoryCache) Del(items ...interface{}) error {
+	_, err := m.del(nil, items...)
+	return err
+}
+
+// Same as Del, but also returns InvalidationResult which describes removed and missing keys, errors and expansions.
+// Returned error is the same as Del.
+func (m *MemoryCache) DelWithResult(items ...interface{}) (*InvalidationResult, error) {
+	return m.del(newInvalidationResult(items), items...)
+}
+
+// Same as DelWithResult on memory cache
+func (m *MemoryCache) UnlinkWithResult(items ...interface{}) (*InvalidationResult, error) {
+	return m.DelWithResult(items...)
+}
+
+// Delete items, and schedule the second deletion if double delete is enabled
+func (m *MemoryCache) del(res *InvalidationResult, items ...interface{}) (*InvalidationResult, error) {
+	res, err := m.invalidate(res, items...)
+	m.double.schedule("DEL", items...)
+	return res, err
+}
+
+// Delete items. res is filled if it's not nil
+func (m *MemoryCache) invalidate(res *InvalidationResult, items ...interface{}) (*InvalidationResult, error) {
+	w := newWalkState(m.maxDepth, m.w)
+	deleteKeys, walkErr := m.factoryDeleteKeys("DEL", w, m.rootKeys("DEL", items...))
+
+	if len(deleteKeys) == 0 && len(w.kept) == 0 {
 		debug(m.w, "[DEL] delete relevant caches are empty. skipped\n")
-		return nil
+		return finishResult(res, w), walkErr
 	}
 
 	debug(m.w, fmt.Sprintf("[DEL] delete relevant caches %q\n", deleteKeys))
+	m.deleteKeys("DEL", deleteKeys, w, res)
+	return finishResult(res, w), walkErr
+}
+
+// Delete keys which are resolved by walking, and remove them from indexes. res is filled if it's not nil
+func (m *MemoryCache) deleteKeys(method string, keys []string, w *walkState, res *InvalidationResult) {
+	keys = append(keys, w.keptDeletes()...)
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, k := range deleteKeys {
-		if _, ok := m.data[k]; ok {
+	for _, k := range keys {
+		entry, ok := m.data[k]
+		if ok {
 			delete(m.data, k)
 		}
+		if res != nil {
+			res.resolve(k, ok && !entry.Expired())
+		}
+		delete(m.dependents, k)
+	}
+	m.applyCascadeActions(method, w)
+	removeIndex(m.dependents, w.unindex)
+	removeIndex(m.tags, w.untag)
+}
+
+// Apply actions to records which are kept on cascading deletion, mu must be locked by caller
+func (m *MemoryCache) applyCascadeActions(method string, w *walkState) {
+	now := time.Now()
+	for _, key := range w.keptKeys {
+		k := w.kept[key]
+		switch k.action.kind {
+		case cascadeActionExpire:
+			debug(m.w, fmt.Sprintf("[%s] shorten TTL of %s to %s\n", method, key, k.action.ttl))
+			expiration := now.Add(k.action.ttl)
+			for _, c := range append([]string{key}, k.chunks...) {
+				entry, ok := m.data[c]
+				if ok && (entry.expiration.IsZero() || entry.expiration.After(expiration)) {
+					entry.expiration = expiration
+					m.data[c] = entry
+				}
+			}
+		case cascadeActionStale:
+			// Record is set again while walking
+			entry, ok := m.data[key]
+			if !ok || !bytes.Equal(entry.data, k.data) {
+				continue
+			}
+			stale, err := markStale(k.data, now)
+			if err != nil {
+				debug(m.w, fmt.Sprintf("[%s] failed to mark %s as stale, %s\n", method, key, err.Error()))
+				continue
+			}
+			debug(m.w, fmt.Sprintf("[%s] mark %s as stale\n", method, key))
+			entry.data = stale
+			m.data[key] = entry
+		}
+	}
+}
+
+func removeIndex(index map[string]*memoryDependents, remove map[string][]string) {
+	for p, keys := range remove {
+		d, ok := index[p]
+		if !ok {
+			continue
+		}
+		for _, k := range keys {
+			delete(d.keys, k)
+		}
+		if len(d.keys) == 0 {
+			delete(index, p)
+		}
 	}
-	return nil
+}
+
+// Delete keys which have any of tags, and their relevant caches.
+// Keys which have expired or no longer have the tag are skipped.
+func (m *MemoryCache) InvalidateTags(tags ...string) error {
+	records := map[string][]byte{}
+	tagged := map[string][]string{}
+	m.mu.Lock()
+	for _, t := range tags {
+		d, ok := m.tags[t]
+		if !ok {
+			continue
+		}
+		for k := range d.keys {
+			tagged[t] = append(tagged[t], k)
+			if entry, ok := m.data[k]; ok && !entry.Expired() {
+				records[k] = entry.record()
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	w := newWalkState(m.maxDepth, m.w)
+	roots := []string{}
+	for _, t := range tags {
+		keys := tagged[t]
+		sort.Strings(keys)
+		debug(m.w, fmt.Sprintf("[TAG] %s is tagged to %q\n", t, keys))
+		for _, k := range keys {
+			r, err := decodeRecord(records[k])
+			if err != nil || r == nil || !r.hasTag(t) {
+				debug(m.w, fmt.Sprintf("[REL] %s no longer has tag %s, skipped\n", k, t))
+				continue
+			}
+			roots = append(roots, k)
+		}
+		// Skipped keys are also removed because they no longer have the tag
+		w.untag[t] = append(w.untag[t], keys...)
+	}
+	deleteKeys, walkErr := m.factoryDeleteKeys("TAG", w, roots)
+	debug(m.w, fmt.Sprintf("[TAG] delete relevant caches %q\n", deleteKeys))
+	m.deleteKeys("TAG", deleteKeys, w, nil)
+	return walkErr
+}
+
+// Cancel pending second deletions of double delete for items. Returns the count of canceled ones
+func (m *MemoryCache) CancelDoubleDelete(items ...interface{}) int {
+	return m.double.cancel(items...)
+}
+
+// Get counts of second deletions of double delete
+func (m *MemoryCache) DoubleDeleteStats() DoubleDeleteStats {
+	return m.double.stats()
 }
 
 func (m *MemoryCache) Unlink(keys ...interface{}) error {
@@ -195,20 +793,61 @@ func (m *MemoryCache) Unlink(keys ...interface{}) error {
 	return m.Del(keys...)
 }
 
+// Resolve keys which would be deleted by Del or Unlink with edges which lead to them. Nothing is deleted.
+func (m *MemoryCache) Resolve(items ...interface{}) (*InvalidationPlan, error) {
+	w := newWalkState(m.maxDepth, m.w)
+	w.trace = true
+	roots := m.rootKeys("RESOLVE", items...)
+	keys, err := m.factoryDeleteKeys("RESOLVE", w, roots)
+	return newInvalidationPlan(roots, keys, w), err
+}
+
+func (m *MemoryCache) rootKeys(method string, items ...interface{}) []string {
+	roots := []string{}
+	for _, v := range items {
+		key, err := getKey(v)
+		if err != nil {
+			debug(m.w, fmt.Sprintf("[%s] invalid keys:%v,  %s\n", method, v, err.Error()))
+			continue
+		}
+		debug(m.w, fmt.Sprintf("[%s] key is: %s\n", method, key))
+		roots = append(roots, key)
+	}
+	return roots
+}
+
+func (m *MemoryCache) factoryDeleteKeys(method string, w *walkState, roots []string) ([]string, error) {
+	deleteKeys := []string{}
+	var walkErr error
+	for _, key := range roots {
+		keys, err := m.factoryRelevantKeys(key, strings.Contains(key, "*"), CascadeAction{}, w)
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
+		debug(m.w, fmt.Sprintf("[%s] factory keys are: %q\n", method, keys))
+		deleteKeys = append(deleteKeys, keys...)
+	}
+	return deleteKeys, walkErr
+}
+
 func (m *MemoryCache) Dump() string {
 	return fmt.Sprintf("%+v", m.data)
 }
 
-// Resolve and factory of relevant cahce keys.
-// To resolve relevant cahe keys, we access to redis eatch time.
-// It might be affect to performance, so we recommend to nesting cahe at least less than 4 or 5.
-func (m *MemoryCache) factoryRelevantKeys(key string) []string {
-	// When key contains asterisk sign, whe should list as KEYS command to match against keys
-	if strings.Contains(key, "*") {
-		return m.factoryRelevantKeysWithAsterisk(key)
+// Resolve and factory of relevant cahce keys by depth-first walk.
+// Each key is visited once even if relations have cycles, and relations are not followed over max relevance depth.
+// edge is the action of the edge which reaches the key, roots use unset action.
+func (m *MemoryCache) factoryRelevantKeys(key string, wildcard bool, edge CascadeAction, w *walkState) ([]string, error) {
+	// When key is wildcard, whe should list as KEYS command to match against keys
+	if wildcard {
+		return m.factoryRelevantKeysWithAsterisk(key, edge, w)
 	}
+	if !w.enter(key) {
+		w.strengthen(key, edge)
+		return nil, nil
+	}
+	defer w.leave()
 
-	relevantKeys := []string{key}
 	record := func(k string) []byte {
 		m.mu.Lock()
 		defer m.mu.Unlock()
@@ -218,62 +857,207 @@ func (m *MemoryCache) factoryRelevantKeys(key string) []string {
 			return nil
 		}
 		if b.Expired() {
-			delete(m.data, k)
+			m.dropExpired(k, b)
 			return nil
 		}
-		return b.data
+		return b.record()
 	}(key)
 
-	if record == nil {
-		return relevantKeys
-	}
+	return m.walkKey(key, record, edge, w)
+}
 
-	keys, _ := decodeMeta(record)
-	if keys == nil {
-		return relevantKeys
+// Factory keys which should be deleted with the key. record is nil if the key doesn't exist.
+// Roots are always deleted, and other keys are kept when the resolved action isn't delete.
+func (m *MemoryCache) walkKey(key string, record []byte, edge CascadeAction, w *walkState) ([]string, error) {
+	action := CascadeDelete
+	if len(w.path) > 1 {
+		r, _ := decodeRecord(record)
+		action = resolveCascadeAction(r, []CascadeAction{edge})
+		// Hash can't be served as stale, so it's deleted instead
+		if action == CascadeStale && m.isHash(key) {
+			action = CascadeDelete
+		}
 	}
-	relevant := bytes.Split(keys, []byte(keyDelimiter))
-	for _, v := range relevant {
-		rKeys := m.factoryRelevantKeys(string(v))
-		relevantKeys = append(relevantKeys, rKeys...)
+	relevantKeys := []string{}
+	if action == CascadeDelete {
+		relevantKeys = append(relevantKeys, key)
+	}
+	var walkErr error
+	if record != nil {
+		keys, err := m.walkRecord(key, record, action, w)
+		relevantKeys = append(relevantKeys, keys...)
+		walkErr = err
+	}
+	keys, err := m.factoryDependentKeys(key, w)
+	if err != nil && walkErr == nil {
+		walkErr = err
 	}
+	relevantKeys = append(relevantKeys, keys...)
 
 	debug(m.w, fmt.Sprintf("[REL] %s is relevant to %q\n", key, relevantKeys))
-	return relevantKeys
+	return relevantKeys, walkErr
 }
 
-// Dealing asterisk sign
-func (m *MemoryCache) factoryRelevantKeysWithAsterisk(key string) []string {
+func (m *MemoryCache) isHash(key string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	entry, ok := m.data[key]
+	return ok && entry.hash
+}
 
-	regex, err := regexp.Compile(
-		strings.ReplaceAll(key, "*", ".*"),
-	)
+// Factory chunk keys and relevant keys of the record.
+// Record which is kept with action still cascades to relevant keys, but its chunks and indexes are kept.
+func (m *MemoryCache) walkRecord(key string, record []byte, action CascadeAction, w *walkState) ([]string, error) {
+	r, err := m.opts.decodeForWalk(key, record)
 	if err != nil {
-		debug(m.w, fmt.Sprintf("failed to compile regex on dealing asterisk sign: %s\n", err.Error()))
+		debug(m.w, fmt.Sprintf("[REL] %s\n", err.Error()))
+		return nil, w.fail(key, err)
+	} else if r == nil {
+		if action != CascadeDelete {
+			w.keep(key, action, record, nil)
+		}
+		return nil, nil
+	}
+	chunkKeys, err := r.chunkKeys()
+	if err != nil {
+		return chunkKeys, w.fail(key, corruptRecord(key, err))
+	}
+	for _, k := range chunkKeys {
+		w.edge(key, k, EdgeChunk, "")
+	}
+	relevantKeys := chunkKeys
+	if action == CascadeDelete {
+		w.unindexDependent(r, key)
+	} else {
+		w.keep(key, action, record, chunkKeys)
+		relevantKeys = []string{}
+	}
+	keys, err := r.relevantKeys()
+	if err != nil {
+		return relevantKeys, w.fail(key, corruptRecord(key, err))
+	}
+	if len(keys) > 0 {
+		if err := w.descend(); err != nil {
+			return relevantKeys, err
+		}
+	}
+	var walkErr error
+	for _, v := range keys {
+		// Edges to matched keys are recorded on dealing asterisk sign
+		wildcard := r.isWildcard(v)
+		if !wildcard {
+			w.edge(key, v, EdgeRelevant, "")
+		}
+		rKeys, err := m.factoryRelevantKeys(v, wildcard, r.edgeAction(v), w)
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
+		relevantKeys = append(relevantKeys, rKeys...)
+	}
+	return relevantKeys, walkErr
+}
+
+// Factory keys which depend on parent from reverse dependency index.
+// Dependents which have expired or no longer depend on parent are skipped.
+func (m *MemoryCache) factoryDependentKeys(parent string, w *walkState) ([]string, error) {
+	records := map[string][]byte{}
+	m.mu.Lock()
+	if d, ok := m.dependents[parent]; ok {
+		for k := range d.keys {
+			entry, ok := m.data[k]
+			if !ok || entry.Expired() {
+				delete(d.keys, k)
+				continue
+			}
+			records[k] = entry.record()
+		}
+	}
+	m.mu.Unlock()
+
+	dependents := make([]string, 0, len(records))
+	for k := range records {
+		dependents = append(dependents, k)
 	}
+	sort.Strings(dependents)
+
 	relevantKeys := []string{}
+	var walkErr error
+	for _, k := range dependents {
+		r, err := decodeRecord(records[k])
+		if err != nil || r == nil || !r.dependsOn(parent) {
+			debug(m.w, fmt.Sprintf("[REL] %s no longer depends on %s, skipped\n", k, parent))
+			continue
+		}
+		if err := w.descend(); err != nil {
+			return relevantKeys, err
+		}
+		w.edge(parent, k, EdgeDependent, "")
+		if !w.enter(k) {
+			w.strengthen(k, CascadeAction{})
+			continue
+		}
+		keys, err := m.walkKey(k, records[k], CascadeAction{}, w)
+		w.leave()
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
+		relevantKeys = append(relevantKeys, keys...)
+	}
+	return relevantKeys, walkErr
+}
+
+// Dealing asterisk sign. Keys are matched with the same glob semantics as redis within wildcard budget.
+// Matched keys are walked as relevant keys, so their relations, dependents and chunks cascade as well.
+func (m *MemoryCache) factoryRelevantKeysWithAsterisk(key string, edge CascadeAction, w *walkState) ([]string, error) {
+	records := map[string][]byte{}
+	m.mu.Lock()
+	s := newWildcardScanner(lastKey(w.path), key, m.budget)
 	for k, v := range m.data {
-		if !regex.MatchString(k) {
+		if !s.next() {
+			break
+		}
+		s.add(1)
+		if !globMatch(key, k) {
 			continue
 		}
 		if v.Expired() {
-			delete(m.data, k)
+			m.dropExpired(k, v)
 			continue
 		}
-		relevantKeys = append(relevantKeys, k)
+		s.add(0, k)
+		records[k] = v.record()
+	}
+	m.mu.Unlock()
+	budgetErr := w.expanded(s.e)
+
+	relevantKeys := []string{}
+	walkErr := budgetErr
+	for _, k := range s.e.Matched {
+		w.edge(lastKey(w.path), k, EdgeRelevant, key)
+		if !w.enter(k) {
+			w.strengthen(k, edge)
+			continue
+		}
+		keys, err := m.walkKey(k, records[k], edge, w)
+		w.leave()
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
+		relevantKeys = append(relevantKeys, keys...)
 	}
 	debug(m.w, fmt.Sprintf("[REL-ASTERISK] %s is relevant to %q\n", key, relevantKeys))
 
-	return relevantKeys
+	return relevantKeys, walkErr
 }
 
+// Get multiple caches. value is nil for missing key.
+// If corrupt records are found, value is nil for them and first *CorruptRecordError is returned with other values.
 func (m *MemoryCache) MGet(keys ...interface{}) ([][]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	ret := make([][]byte, len(keys))
+	var corruptErr error
 
 	for i, k := range keys {
 		key, err := getKey(k)
@@ -286,39 +1070,75 @@ func (m *MemoryCache) MGet(keys ...interface{}) ([][]byte, error) {
 			continue
 		} else if entry.Expired() {
 			ret[i] = nil
-			delete(m.data, key)
+			m.dropExpired(key, entry)
 			continue
+		} else if isStaleRecord(entry.data) {
+			ret[i] = nil
+			continue
+		}
+		data, err := m.opts.payload(key, entry.data, m.fetchChunks)
+		if err != nil {
+			if !IsCorruptRecord(err) {
+				return nil, err
+			}
+			m.dropCorruptRecord(key, entry.data, err)
+			if corruptErr == nil {
+				corruptErr = err
+			}
 		}
-		_, data := decodeMeta(entry.data)
 		ret[i] = data
 	}
-	return ret, nil
+	return ret, corruptErr
 }
 
+// Hash is stored as JSON object of field and byte slice value
+// Set field of JSON-encoded hash. Value is encoded as RawCodec does, the same as redis.
+// When key is *Item which has relations, they are stored in the reserved field so that Del of the hash cascades.
 func (m *MemoryCache) HSet(key interface{}, field string, value interface{}) error {
 	k, err := getKey(key)
 	if err != nil {
 		return err
 	}
+	if field == hashMetaField {
+		return ErrReservedHashField
+	}
+
+	b, _ := RawCodec.Marshal(value)
+	if b, err = m.opts.encodeField(k, field, b); err != nil {
+		return err
+	}
+
+	var meta []byte
+	item, ok := key.(*Item)
+	if ok {
+		meta = hashMeta(item, m.opts.origin)
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	var d map[string]interface{}
+	var d map[string][]byte
 	if entry, ok := m.data[k]; ok {
 		err := json.Unmarshal(entry.data, &d)
 		if err != nil {
 			return err
 		}
-		d[field] = value
+		d[field] = b
+		if meta != nil {
+			d[hashMetaField] = meta
+		}
 		entry.data, err = json.Marshal(d)
 		if err != nil {
 			return err
 		}
+		entry.hash = true
 		m.data[k] = entry
 	} else {
-		d = map[string]interface{}{
-			field: value,
+		d = map[string][]byte{
+			field: b,
+		}
+		if meta != nil {
+			d[hashMetaField] = meta
 		}
 		buf, err := json.Marshal(d)
 		if err != nil {
@@ -327,8 +1147,14 @@ func (m *MemoryCache) HSet(key interface{}, field string, value interface{}) err
 		m.data[k] = memoryCacheEntry{
 			data:       buf,
 			expiration: time.Time{},
+			hash:       true,
 		}
 	}
+	if meta != nil {
+		debug(m.w, fmt.Sprintf("[HSET] hash key %s is relevant to %q\n", k, item.getRelevaneKeys()))
+		m.indexDependent(k, item.getDependsKeys())
+		m.indexTags(k, item.tags)
+	}
 	return nil
 }
 
@@ -342,11 +1168,15 @@ func (m *MemoryCache) HLen(key interface{}) (int64, error) {
 	defer m.mu.Unlock()
 
 	if entry, ok := m.data[k]; ok {
-		var d map[string]interface{}
+		var d map[string][]byte
 		err := json.Unmarshal(entry.data, &d)
 		if err != nil {
 			return 0, err
 		}
+		// The reserved field which holds relations isn't counted
+		if _, ok := d[hashMetaField]; ok {
+			return int64(len(d) - 1), nil
+		}
 		return int64(len(d)), nil
 	}
 	return 0, nil
@@ -357,29 +1187,105 @@ func (m *MemoryCache) HGet(key interface{}, field string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if field == hashMetaField {
+		return nil, ErrReservedHashField
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if entry, ok := m.data[k]; ok {
-		var d map[string]interface{}
+		var d map[string][]byte
 		err := json.Unmarshal(entry.data, &d)
 		if err != nil {
 			return nil, err
 		}
 		if v, ok := d[field]; ok {
-			switch t := v.(type) {
-			case string:
-				return []byte(t), nil
-			case []byte:
-				return t, nil
-			default:
-				return json.Marshal(v)
-			}
+			return m.opts.decodeField(k, field, v)
 		}
 		return nil, RedisNil
 	}
 	return nil, RedisNil
 }
 
+// Export relevance graph of all records in the format.
+// Relevant keys with wildcard are expanded within wildcard budget.
+func (m *MemoryCache) ExportGraph(w io.Writer, format GraphFormat) error {
+	m.mu.Lock()
+	records := make([]graphRecord, 0, len(m.data))
+	now := time.Now()
+	for k, entry := range m.data {
+		if entry.Expired() {
+			continue
+		}
+		ttl := int64(-1)
+		if !entry.expiration.IsZero() {
+			ttl = int64(entry.expiration.Sub(now) / time.Millisecond)
+		}
+		r, err := decodeRecord(entry.record())
+		records = append(records, graphRecord{
+			key:     k,
+			ttl:     ttl,
+			size:    len(entry.data),
+			header:  r,
+			corrupt: err != nil,
+		})
+	}
+	m.mu.Unlock()
+
+	return writeGraph(w, format, buildGraph(records, m.budget))
+}
+
+// Scan keys for migration. cursor is offset of sorted keys
+func (m *MemoryCache) scanKeys(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	m.mu.Unlock()
+	sort.Strings(keys)
+
+	if count <= 0 {
+		count = 10
+	}
+	start := int(cursor)
+	if start > len(keys) {
+		start = len(keys)
+	}
+	end := start + int(count)
+	var next uint64
+	if end < len(keys) {
+		next = uint64(end)
+	} else {
+		end = len(keys)
+	}
+	matched := []string{}
+	for _, k := range keys[start:end] {
+		if globMatch(match, k) {
+			matched = append(matched, k)
+		}
+	}
+	return matched, next, nil
+}
+
+// Rewrite record with keeping expiration
+func (m *MemoryCache) rewriteRecord(key string, fn func(dat []byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.data[key]
+	if !ok || entry.Expired() {
+		return errMigrationUnmatched
+	}
+	converted, err := fn(entry.data)
+	if err != nil || converted == nil {
+		return err
+	}
+	entry.data = converted
+	m.data[key] = entry
+	return nil
+}
+
 var _ Cache = (*MemoryCache)(nil)
+var _ recordStore = (*MemoryCache)(nil)
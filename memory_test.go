@@ -1,7 +1,14 @@
 package relevantcache_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	rc "github.com/ysugimoto/relevantcache"
@@ -214,6 +221,12 @@ func TestMemoryCacheHGet(t *testing.T) {
 	v, err := c.HGet("hget_key01", "user01")
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("foobar"), v)
+
+	// Other types than string and []byte are encoded as RawCodec does, the same as redis
+	assert.NoError(t, c.HSet("hget_key01", "user02", []int{1, 2}))
+	v, err = c.HGet("hget_key01", "user02")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("[1 2]"), v)
 }
 
 func TestMemoryCacheHGetWithRelevantKey(t *testing.T) {
@@ -229,3 +242,774 @@ func TestMemoryCacheHGetWithRelevantKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("foobar"), v)
 }
+
+func TestMemoryCacheGetValueWithCodec(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	c := rc.NewMemoryCache(rc.WithCodec(rc.JSONCodec))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("user", 1).Value(user{Name: "foo", Age: 1})))
+	assert.NoError(t, c.Set(rc.NewItem("user", 2).Value(user{Name: "bar", Age: 2}).Codec(rc.GobCodec)))
+
+	var u user
+	assert.NoError(t, c.GetValue("user_1", &u))
+	assert.Equal(t, user{Name: "foo", Age: 1}, u)
+	assert.NoError(t, c.GetValue("user_2", &u))
+	assert.Equal(t, user{Name: "bar", Age: 2}, u)
+
+	v, err := c.Get("user_1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"Name":"foo","Age":1}`), v)
+}
+
+func TestMemoryCacheSetAndGetWithCompression(t *testing.T) {
+	for _, algo := range []rc.Compression{rc.CompressionGzip, rc.CompressionSnappy} {
+		c := rc.NewMemoryCache(rc.WithCompression(algo, 64))
+
+		large := strings.Repeat("lorem ipsum ", 100)
+		assert.NoError(t, c.Set("parent_1", large))
+		assert.NoError(t, c.Set(rc.NewItem("child", 10).Value(large).RelevantTo("parent", 1)))
+		assert.NoError(t, c.Set(rc.NewItem("child", 20).Value("small").RelevantTo("parent", 1)))
+
+		for _, key := range []string{"parent_1", "child_10"} {
+			v, err := c.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(large), v)
+		}
+		values, err := c.MGet("child_10", "child_20")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(large), values[0])
+		assert.Equal(t, []byte("small"), values[1])
+
+		keys := c.FactoryRelevantKeys("child_10")
+		assert.Equal(t, []string{"child_10", "parent_1"}, keys)
+		c.Close()
+	}
+}
+
+func TestMemoryCacheSetAndGetWithSplitBuffer(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithSplitBufferSize(100))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 30)
+	assert.NoError(t, c.Set("parent_1", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value(large).RelevantTo("parent", 1)))
+
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), v)
+	values, err := c.MGet("child_10", "parent_1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), values[0])
+	assert.Equal(t, []byte("parent"), values[1])
+
+	keys := c.FactoryRelevantKeys("child_10")
+	assert.Equal(t, []string{
+		"child_10",
+		"child_10:chunk:0",
+		"child_10:chunk:1",
+		"child_10:chunk:2",
+		"child_10:chunk:3",
+		"parent_1",
+	}, keys)
+
+	// Overwrite with smaller value, stale chunks should be removed
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value(large[:150]).RelevantTo("parent", 1)))
+	_, err = c.Get("child_10:chunk:2")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Del("child_10"))
+	for _, k := range []string{"child_10", "child_10:chunk:0", "child_10:chunk:1", "parent_1"} {
+		_, err = c.Get(k)
+		assert.Error(t, err)
+	}
+}
+
+func TestMemoryCacheDetectCorruptRecord(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithCorruptRecordPolicy(rc.CorruptRecordDelete))
+	defer c.Close()
+
+	b := rc.EncodeItemWithChecksum(rc.NewItem("child", 10).Value("child").RelevantTo("parent", 1))
+	assert.NoError(t, c.Set("child_10", b))
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("child"), v)
+
+	// Break record data
+	broken := append([]byte{}, b...)
+	broken[len(broken)-1] = 'X'
+	assert.NoError(t, c.Set("child_10", broken))
+	assert.NoError(t, c.Set("child_20", broken))
+	assert.NoError(t, c.Set("other", "value"))
+
+	values, err := c.MGet("other", "child_20")
+	assert.True(t, errors.Is(err, rc.ErrCorruptRecord))
+	assert.Equal(t, []byte("value"), values[0])
+	assert.Nil(t, values[1])
+
+	_, err = c.Get("child_10")
+	assert.True(t, errors.Is(err, rc.ErrCorruptRecord))
+	var cre *rc.CorruptRecordError
+	assert.True(t, errors.As(err, &cre))
+	assert.Equal(t, "child_10", cre.Key)
+
+	// Corrupt record has been deleted by policy
+	_, err = c.Get("child_10")
+	assert.False(t, rc.IsCorruptRecord(err))
+	assert.Error(t, err)
+}
+
+func TestMemoryCacheDelCorruptRecord(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	b := rc.EncodeItemWithChecksum(rc.NewItem("child", 10).Value("child").RelevantTo("parent", 1))
+	b[len(b)-1] = 'X'
+	assert.NoError(t, c.Set("parent_1", "parent"))
+	assert.NoError(t, c.Set("child_10", b))
+
+	// Corrupt record is deleted but relevant keys can't be trusted
+	err := c.Del("child_10")
+	assert.True(t, rc.IsCorruptRecord(err))
+	_, err = c.Get("child_10")
+	assert.Error(t, err)
+	_, err = c.Get("parent_1")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCacheRelevantKeyContainsDelimiter(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set("parent|1", "parent"))
+	assert.NoError(t, c.Set("parent", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value("child").RelevantTo("parent|1")))
+
+	keys := c.FactoryRelevantKeys("child_10")
+	assert.Equal(t, []string{"child_10", "parent|1"}, keys)
+
+	// Legacy records join relevant keys with delimiter
+	legacy := append([]byte{'$', 0, 0, 8}, []byte("parent|1child")...)
+	assert.NoError(t, c.Set("child_20", legacy))
+	keys = c.FactoryRelevantKeys("child_20")
+	assert.Equal(t, []string{"child_20", "parent", "1"}, keys)
+}
+
+func TestMemoryCacheGetWithMeta(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithOrigin("api"))
+	defer c.Close()
+
+	now := time.Now()
+	item := rc.NewItem("child", 10).Value("child").RelevantTo("parent", 1).Version(3).Tags("product:12", "catalog")
+	assert.NoError(t, c.Set(item))
+	assert.NoError(t, c.Set(rc.NewItem("child", 20).Value("child").Origin("worker")))
+	assert.NoError(t, c.Set("plain", "value"))
+
+	e, err := c.GetWithMeta("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, "child_10", e.Key)
+	assert.Equal(t, []byte("child"), e.Value)
+	assert.Equal(t, []string{"parent_1"}, e.RelevantKeys)
+	assert.Equal(t, int64(3), e.Version)
+	assert.Equal(t, []string{"product:12", "catalog"}, e.Tags)
+	assert.Equal(t, "api", e.Origin)
+	assert.False(t, e.CreatedAt.Before(now.Truncate(time.Second)))
+
+	e, err = c.GetWithMeta("child_20")
+	assert.NoError(t, err)
+	assert.Equal(t, "worker", e.Origin)
+
+	// Item without version, tags and origin still has created time
+	plain := rc.NewMemoryCache()
+	defer plain.Close()
+	assert.NoError(t, plain.Set(rc.NewItem("child", 30).Value("child")))
+	e, err = plain.GetWithMeta("child_30")
+	assert.NoError(t, err)
+	assert.Empty(t, e.Origin)
+	assert.False(t, e.CreatedAt.Before(now.Truncate(time.Second)))
+
+	e, err = c.GetWithMeta("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), e.Value)
+	assert.True(t, e.CreatedAt.IsZero())
+}
+
+func TestMemoryCacheSetAndGetStream(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithSplitBufferSize(100), rc.WithCompression(rc.CompressionGzip, 0), rc.WithChecksum(true))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 100)
+	assert.NoError(t, c.Set("parent_1", "parent"))
+	assert.NoError(t, c.SetStream(rc.NewItem("child", 10).RelevantTo("parent", 1), strings.NewReader(large)))
+
+	r, err := c.GetStream("child_10")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, large, string(b))
+
+	// Streamed record is readable by Get, and relevant keys work as well
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), v)
+	assert.NoError(t, c.Del("child_10"))
+	_, err = c.Get("parent_1")
+	assert.Error(t, err)
+
+	// Record which is stored by Set and primitive value are also readable as stream
+	assert.NoError(t, c.Set(rc.NewItem("child", 20).Value("child")))
+	assert.NoError(t, c.Set("plain", "value"))
+	for k, expect := range map[string]string{"child_20": "child", "plain": "value"} {
+		r, err := c.GetStream(k)
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(b))
+	}
+}
+
+func TestMemoryCacheGetStreamDetectCorruptChunk(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithSplitBufferSize(100), rc.WithChecksum(true))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 30)
+	assert.NoError(t, c.SetStream(rc.NewItem("child", 10), strings.NewReader(large)))
+	assert.NoError(t, c.Set("child_10:chunk:1", strings.Repeat("X", 100)))
+
+	r, err := c.GetStream("child_10")
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.True(t, rc.IsCorruptRecord(err))
+}
+
+func TestMemoryCacheMigrate(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	legacy := append([]byte{'$', 0, 0, 8}, []byte("parent|1child")...)
+	assert.NoError(t, c.Set("child_10", legacy, 60))
+	assert.NoError(t, c.Set("child_20", []byte("!parent,1@@child")))
+	// User string which looks like readme format but has split keys is kept
+	assert.NoError(t, c.Set("mail", []byte("!alice@example.com@home")))
+	assert.NoError(t, c.Set("plain", "value"))
+
+	progress := 0
+	report, err := rc.Migrate(context.Background(), c, rc.FormatLegacy, rc.FormatV2,
+		rc.WithMigrationBatchSize(2),
+		rc.WithMigrationProgress(func(r rc.MigrationReport) {
+			progress++
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Scanned)
+	assert.Equal(t, 1, report.Migrated)
+	assert.Equal(t, 3, report.Unmatched)
+	assert.Equal(t, 2, progress)
+
+	report, err = rc.Migrate(context.Background(), c, rc.FormatReadme, rc.FormatV2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Migrated)
+	assert.Equal(t, []byte("!alice@example.com@home"), rc.RawValue(c, "mail"))
+
+	for _, k := range []string{"child_10", "child_20"} {
+		e, err := c.GetWithMeta(k)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("child"), e.Value)
+	}
+	assert.Equal(t, []string{"child_10", "parent", "1"}, c.FactoryRelevantKeys("child_10"))
+	assert.Equal(t, []string{"child_20", "parent", "1"}, c.FactoryRelevantKeys("child_20"))
+
+	// Records which have sections can't be migrated to legacy format
+	assert.NoError(t, c.Set(rc.NewItem("child", 30).Value("child").Version(1)))
+	// Created time is dropped because legacy format can't hold it
+	assert.NoError(t, c.Set(rc.NewItem("child", 40).Value("child").RelevantTo("parent", 1)))
+	report, err = rc.Migrate(context.Background(), c, rc.FormatV2, rc.FormatLegacy, rc.WithMigrationMatch("child_*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Migrated)
+	assert.Equal(t, []rc.MigrationSkip{
+		{Key: "child_30", Reason: "record has sections which legacy format can't hold"},
+	}, report.Skipped)
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("child"), v)
+}
+
+func TestMemoryCacheSetAndGetWithEncryption(t *testing.T) {
+	keyring, err := rc.NewKeyring("k1", map[string][]byte{
+		"k1": []byte(strings.Repeat("1", 32)),
+	})
+	assert.NoError(t, err)
+	c := rc.NewMemoryCache(rc.WithEncryption(keyring), rc.WithCompression(rc.CompressionGzip, 0), rc.WithSplitBufferSize(100))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 10000)
+	assert.NoError(t, c.Set("parent_1", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value(large).RelevantTo("parent", 1)))
+	assert.NoError(t, c.SetStream(rc.NewItem("child", 20), strings.NewReader(large)))
+	assert.NoError(t, c.HSet("hash", "field", "secret"))
+
+	values, err := c.MGet("child_10", "child_20", "parent_1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), values[0])
+	assert.Equal(t, []byte(large), values[1])
+	assert.Equal(t, []byte("parent"), values[2])
+	r, err := c.GetStream("child_10")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, large, string(b))
+	v, err := c.HGet("hash", "field")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), v)
+	assert.False(t, strings.Contains(c.Dump(), "secret"))
+
+	// Encrypted data is bound to the cache key
+	rc.SetRawValue(c, "parent_2", rc.RawValue(c, "parent_1"))
+	_, err = c.Get("parent_2")
+	assert.True(t, rc.IsCorruptRecord(err))
+
+	// Relevant keys are readable without data key
+	assert.NoError(t, c.Del("child_10"))
+	_, err = c.Get("parent_1")
+	assert.Error(t, err)
+}
+
+func TestMemoryCacheDelDependents(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set("user_42", "user"))
+	assert.NoError(t, c.Set("summary_42", "summary"))
+	assert.NoError(t, c.Set(rc.NewItem("profile", 42).Value("profile").DependsOn("user", 42).RelevantTo("summary", 42)))
+	assert.NoError(t, c.Set(rc.NewItem("feed", 42).Value("feed").DependsOn("user", 42)))
+	assert.NoError(t, c.Set(rc.NewItem("badge", 42).Value("badge").DependsOn("profile", 42)))
+	// Overwritten record no longer depends on user
+	assert.NoError(t, c.Set(rc.NewItem("stale", 42).Value("stale").DependsOn("user", 42)))
+	assert.NoError(t, c.Set(rc.NewItem("stale", 42).Value("stale")))
+
+	e, err := c.GetWithMeta("profile_42")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user_42"}, e.DependsOn)
+
+	assert.Equal(t, []string{
+		"user_42",
+		"feed_42",
+		"profile_42",
+		"summary_42",
+		"badge_42",
+	}, c.FactoryRelevantKeys("user_42"))
+
+	// Deleting parent which isn't cached also deletes dependents
+	assert.NoError(t, c.Set(rc.NewItem("view", 1).Value("view").DependsOn("product", 1)))
+	assert.NoError(t, c.Del("product_1"))
+	_, err = c.Get("view_1")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Del("user_42"))
+	for _, k := range []string{"user_42", "feed_42", "profile_42", "summary_42", "badge_42"} {
+		_, err = c.Get(k)
+		assert.Error(t, err)
+	}
+	_, err = c.Get("stale_42")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCacheDependentsIndexIsCleanedUp(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("feed", 1).Value("feed").DependsOn("user", 42)))
+	assert.NoError(t, c.Set(rc.NewItem("feed", 2).Value("feed").DependsOn("user", 42).Ttl(1)))
+	assert.Equal(t, 2, rc.DependentsCount(c, "user_42"))
+
+	// Deleted dependent is removed from the index
+	assert.NoError(t, c.Del("feed_1"))
+	assert.Equal(t, 1, rc.DependentsCount(c, "user_42"))
+
+	// Expired dependent is removed on walking
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, []string{"user_42"}, c.FactoryRelevantKeys("user_42"))
+	assert.Equal(t, 0, rc.DependentsCount(c, "user_42"))
+}
+
+func TestMemoryCacheDelRelevanceCycle(t *testing.T) {
+	buf := new(bytes.Buffer)
+	c := rc.NewMemoryCache(rc.WithDebugWriter(buf))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("a").Value("a").RelevantTo("b")))
+	assert.NoError(t, c.Set(rc.NewItem("b").Value("b").RelevantTo("a")))
+	// Diamond: c and d are relevant to e
+	assert.NoError(t, c.Set(rc.NewItem("top").Value("top").RelevantTo("c").RelevantTo("d")))
+	assert.NoError(t, c.Set(rc.NewItem("c").Value("c").RelevantTo("e")))
+	assert.NoError(t, c.Set(rc.NewItem("d").Value("d").RelevantTo("e")))
+	assert.NoError(t, c.Set("e", "e"))
+
+	assert.Equal(t, []string{"a", "b"}, c.FactoryRelevantKeys("a"))
+	assert.Contains(t, buf.String(), "[CYCLE] a -> b -> a")
+	assert.Equal(t, []string{"top", "c", "e", "d"}, c.FactoryRelevantKeys("top"))
+
+	assert.NoError(t, c.Del("a", "top"))
+	for _, k := range []string{"a", "b", "top", "c", "d", "e"} {
+		_, err := c.Get(k)
+		assert.Error(t, err)
+	}
+}
+
+func TestMemoryCacheDelOverMaxRelevanceDepth(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithMaxRelevanceDepth(2))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("k", 0).Value("v").RelevantTo("k", 1)))
+	assert.NoError(t, c.Set(rc.NewItem("k", 1).Value("v").RelevantTo("k", 2)))
+	assert.NoError(t, c.Set(rc.NewItem("k", 2).Value("v").RelevantTo("k", 3)))
+	assert.NoError(t, c.Set("k_3", "v"))
+
+	err := c.Del("k_0")
+	assert.True(t, errors.Is(err, rc.ErrRelevanceDepthExceeded))
+	var de *rc.RelevanceDepthError
+	assert.True(t, errors.As(err, &de))
+	assert.Equal(t, "k_2", de.Key)
+	assert.Equal(t, []string{"k_0", "k_1", "k_2"}, de.Path)
+
+	// Keys within max depth are deleted
+	for _, k := range []string{"k_0", "k_1", "k_2"} {
+		_, err := c.Get(k)
+		assert.Error(t, err)
+	}
+	_, err = c.Get("k_3")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCacheResolve(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("plan_child").Value("child").RelevantTo("plan_parent")))
+	assert.NoError(t, c.Set(rc.NewItem("plan_parent").Value("parent").RelevantTo("plan_list_*")))
+	assert.NoError(t, c.Set("plan_list_1", "1"))
+	assert.NoError(t, c.Set(rc.NewItem("plan_view").Value("view").DependsOn("plan_child")))
+
+	plan, err := c.Resolve("plan_child")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plan_child"}, plan.Roots)
+	assert.Equal(t, []string{"plan_child", "plan_parent", "plan_list_1", "plan_view"}, plan.Keys)
+	assert.Equal(t, []rc.InvalidationEdge{
+		{From: "plan_parent", To: "plan_list_1", Kind: rc.EdgeRelevant, Pattern: "plan_list_*"},
+	}, plan.EdgesTo("plan_list_1"))
+	assert.Equal(t, []rc.InvalidationEdge{
+		{From: "plan_child", To: "plan_view", Kind: rc.EdgeDependent},
+	}, plan.EdgesTo("plan_view"))
+	assert.Equal(t, []string{"plan_list_1"}, plan.WildcardKeys())
+
+	// Nothing is deleted
+	for _, k := range plan.Keys {
+		_, err := c.Get(k)
+		assert.NoError(t, err)
+	}
+}
+
+func TestMemoryCacheExportGraph(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("graph_child").Value("child").RelevantTo("graph_list_*").Ttl(60)))
+	assert.NoError(t, c.Set("graph_list_1", "1"))
+	assert.NoError(t, c.Set(rc.NewItem("graph_view").Value("view").DependsOn("graph_child")))
+	assert.NoError(t, c.HSet(rc.NewItem("graph_hash").RelevantTo("graph_child"), "field", "value"))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, c.ExportGraph(buf, rc.GraphJSON))
+	var g rc.Graph
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &g))
+	assert.Len(t, g.Nodes, 4)
+	assert.Equal(t, "graph_child", g.Nodes[0].Key)
+	assert.True(t, g.Nodes[0].TTL > 59000)
+	assert.Equal(t, int64(-1), g.Nodes[2].TTL)
+	assert.Equal(t, 1, g.Nodes[2].Size)
+	assert.Contains(t, buf.String(), `{"from":"graph_child","to":"graph_list_1","kind":"relevant","wildcard":true,"pattern":"graph_list_*"}`)
+	assert.Contains(t, buf.String(), `{"from":"graph_child","to":"graph_view","kind":"dependent"}`)
+	// Relations of hash are read from the reserved field
+	assert.Contains(t, buf.String(), `{"from":"graph_hash","to":"graph_child","kind":"relevant"}`)
+
+	buf.Reset()
+	assert.NoError(t, c.ExportGraph(buf, rc.GraphDOT))
+	assert.True(t, strings.HasPrefix(buf.String(), "digraph relevantcache {\n"))
+	assert.Contains(t, buf.String(), `  "graph_list_1" [label="graph_list_1\nttl=none size=1"];`)
+	assert.Contains(t, buf.String(), `  "graph_child" -> "graph_list_1" [label="relevant graph_list_*", style=dashed];`)
+	assert.Contains(t, buf.String(), `  "graph_child" -> "graph_view" [label="dependent"];`)
+
+	// Wildcard edges are limited by budget
+	b := rc.NewMemoryCache(rc.WithWildcardBudget(rc.WildcardBudget{MaxMatches: 1}))
+	defer b.Close()
+	assert.NoError(t, b.Set(rc.NewItem("graph_child").Value("child").RelevantTo("graph_list_*")))
+	assert.NoError(t, b.Set("graph_list_1", "1"))
+	assert.NoError(t, b.Set("graph_list_2", "2"))
+	buf.Reset()
+	assert.NoError(t, b.ExportGraph(buf, rc.GraphJSON))
+	g = rc.Graph{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &g))
+	assert.Len(t, g.Edges, 1)
+}
+
+func TestMemoryCacheInvalidateTags(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set("tag_parent", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("tag_product").Value("product").Tags("product:12", "catalog").RelevantTo("tag_parent")))
+	assert.NoError(t, c.Set(rc.NewItem("tag_list").Value("list").Tags("catalog")))
+	assert.NoError(t, c.Set(rc.NewItem("tag_other").Value("other").Tags("catalog")))
+	// overwritten record doesn't have the tag anymore
+	assert.NoError(t, c.Set(rc.NewItem("tag_other").Value("other")))
+	assert.NoError(t, c.Set(rc.NewItem("tag_view").Value("view").DependsOn("tag_list")))
+
+	assert.NoError(t, c.InvalidateTags("product:12"))
+	for _, k := range []string{"tag_product", "tag_parent"} {
+		_, err := c.Get(k)
+		assert.Error(t, err, k)
+	}
+	_, err := c.Get("tag_list")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.InvalidateTags("catalog"))
+	for _, k := range []string{"tag_list", "tag_view"} {
+		_, err := c.Get(k)
+		assert.Error(t, err, k)
+	}
+	_, err = c.Get("tag_other")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCacheExpiryCascade(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithExpiryCascade(true), rc.WithJanitorInterval(10*time.Millisecond))
+	defer c.Close()
+
+	assert.NoError(t, c.Set("expiry_parent", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("expiry_child").Value("child").RelevantTo("expiry_parent").Ttl(60)))
+	assert.NoError(t, c.Set(rc.NewItem("expiry_view").Value("view").DependsOn("expiry_child")))
+	assert.NoError(t, c.Set("expiry_other", "other"))
+
+	rc.ExpireNow(c, "expiry_child")
+	assert.Eventually(t, func() bool {
+		_, err := c.Get("expiry_parent")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err := c.Get("expiry_view")
+	assert.Error(t, err)
+	_, err = c.Get("expiry_other")
+	assert.NoError(t, err)
+
+	// Janitor is stopped
+	assert.NoError(t, c.Close())
+}
+
+func TestMemoryCacheExpiryCascadeOnLazyDeletion(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithExpiryCascade(true), rc.WithJanitorInterval(10*time.Millisecond))
+	defer c.Close()
+
+	assert.NoError(t, c.Set("expiry_parent", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("expiry_child").Value("child").RelevantTo("expiry_parent").Ttl(60)))
+
+	rc.ExpireNow(c, "expiry_child")
+	// Expired record is deleted by Get, and it's cascaded by janitor
+	_, err := c.Get("expiry_child")
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := c.Get("expiry_parent")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryCacheCascadeActions(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set("action_stale", "stale"))
+	assert.NoError(t, c.Set("action_expire", "expire"))
+	assert.NoError(t, c.Set("action_both", "both"))
+	assert.NoError(t, c.Set(rc.NewItem("action_mid").Value("mid").RelevantTo("action_both")))
+	assert.NoError(t, c.Set(rc.NewItem("action_view").Value("view").DependsOn("action_root").OnCascade(rc.CascadeStale)))
+	assert.NoError(t, c.Set(rc.NewItem("action_root").Value("root").
+		CascadeTo(rc.CascadeStale, "action_stale").
+		CascadeTo(rc.CascadeExpire(50*time.Millisecond), "action_expire").
+		RelevantTo("action_mid").
+		CascadeTo(rc.CascadeStale, "action_both")))
+
+	plan, err := c.Resolve("action_root")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]rc.CascadeAction{
+		"action_stale":  rc.CascadeStale,
+		"action_expire": rc.CascadeExpire(50 * time.Millisecond),
+		"action_view":   rc.CascadeStale,
+	}, plan.Actions)
+
+	assert.NoError(t, c.Del("action_root"))
+	// action_both is deleted because it's also reached by action_mid
+	for _, k := range []string{"action_root", "action_mid", "action_both", "action_stale", "action_view"} {
+		_, err := c.Get(k)
+		assert.Error(t, err, k)
+	}
+	v, stale, err := c.GetStale("action_stale")
+	assert.NoError(t, err)
+	assert.True(t, stale)
+	assert.Equal(t, []byte("stale"), v)
+	_, stale, err = c.GetStale("action_view")
+	assert.NoError(t, err)
+	assert.True(t, stale)
+
+	v, err = c.Get("action_expire")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("expire"), v)
+	assert.Eventually(t, func() bool {
+		_, err := c.Get("action_expire")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryCacheWildcardBudget(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithWildcardBudget(rc.WildcardBudget{MaxMatches: 2}))
+	defer c.Close()
+
+	for _, k := range []string{"wc_1", "wc_2", "wc_3", "wc_lit*", "wc_lit1"} {
+		assert.NoError(t, c.Set(k, "v"))
+	}
+	assert.NoError(t, c.Set(rc.NewItem("wc_root").Value("root").RelevantMatch("wc_?").RelevantExact("wc_lit*")))
+
+	plan, err := c.Resolve("wc_root")
+	assert.True(t, errors.Is(err, rc.ErrWildcardBudgetExceeded))
+	assert.Len(t, plan.Expansions, 1)
+	assert.Equal(t, "wc_root", plan.Expansions[0].From)
+	assert.Equal(t, rc.WildcardMaxMatches, plan.Expansions[0].Limit)
+	assert.Len(t, plan.Expansions[0].Matched, 2)
+
+	err = c.Del("wc_root")
+	assert.True(t, errors.Is(err, rc.ErrWildcardBudgetExceeded))
+	remains := []string{}
+	for _, k := range []string{"wc_1", "wc_2", "wc_3", "wc_lit*", "wc_lit1"} {
+		if _, err := c.Get(k); err == nil {
+			remains = append(remains, k)
+		}
+	}
+	// wc_lit* is matched exactly, and one of wc_? remains over budget
+	assert.Len(t, remains, 2)
+	assert.Contains(t, remains, "wc_lit1")
+	assert.NotContains(t, remains, "wc_lit*")
+
+	// Matches up to max matches are completed without error
+	e := rc.NewMemoryCache(rc.WithWildcardBudget(rc.WildcardBudget{MaxMatches: 2}))
+	defer e.Close()
+	assert.NoError(t, e.Set("wc_1", "v"))
+	assert.NoError(t, e.Set("wc_2", "v"))
+	assert.NoError(t, e.Set("wc_other", "v"))
+	assert.NoError(t, e.Set(rc.NewItem("wc_root").Value("root").RelevantMatch("wc_?")))
+	plan, err = e.Resolve("wc_root")
+	assert.NoError(t, err)
+	assert.False(t, plan.Expansions[0].Truncated())
+	assert.Len(t, plan.Expansions[0].Matched, 2)
+	assert.NoError(t, e.Del("wc_root"))
+}
+
+func TestMemoryCacheDelWithResult(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithMaxRelevanceDepth(2))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("result_root").Value("root").RelevantTo("result_child").RelevantTo("result_gone")))
+	assert.NoError(t, c.Set(rc.NewItem("result_child").Value("child").RelevantTo("result_leaf")))
+	assert.NoError(t, c.Set(rc.NewItem("result_leaf").Value("leaf").RelevantTo("result_deep")))
+	assert.NoError(t, c.Set("result_deep", "deep"))
+
+	res, err := c.DelWithResult("result_root", 42)
+	assert.True(t, errors.Is(err, rc.ErrRelevanceDepthExceeded))
+	assert.Equal(t, []string{"result_root"}, res.Requested)
+	assert.ElementsMatch(t, []string{"result_root", "result_child", "result_leaf"}, res.Removed)
+	assert.Equal(t, []string{"result_gone"}, res.Missing)
+	assert.Len(t, res.Resolved, 4)
+	assert.Len(t, res.Errors, 2)
+	assert.True(t, errors.Is(res.Errors["result_leaf"], rc.ErrRelevanceDepthExceeded))
+	assert.Error(t, res.Errors["42"])
+	assert.True(t, res.Elapsed > 0)
+
+	assert.NoError(t, c.Del("result_deep"))
+}
+
+func TestMemoryCacheDelAfter(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("schedule_root").Value("root").RelevantTo("schedule_child")))
+	assert.NoError(t, c.Set("schedule_child", "child"))
+	assert.NoError(t, c.Set("schedule_later", "later"))
+
+	assert.NoError(t, c.DelAt(time.Now().Add(time.Hour), "schedule_root"))
+	// Scheduling again replaces the time
+	assert.NoError(t, c.DelAfter(30*time.Millisecond, "schedule_root"))
+	assert.NoError(t, c.DelAfter(time.Hour, "schedule_later"))
+	_, err := c.Get("schedule_root")
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err1 := c.Get("schedule_root")
+		_, err2 := c.Get("schedule_child")
+		return err1 != nil && err2 != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = c.Get("schedule_later")
+	assert.NoError(t, err)
+}
+
+func TestMemoryCacheDoubleDelete(t *testing.T) {
+	c := rc.NewMemoryCache(rc.WithDoubleDelete(30 * time.Millisecond))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("double_root").Value("root").RelevantTo("double_child")))
+	assert.NoError(t, c.Set("double_child", "child"))
+	assert.NoError(t, c.Del("double_root", "double_canceled"))
+	// Stale data is written back by a reader after the first deletion
+	assert.NoError(t, c.Set(rc.NewItem("double_root").Value("stale").RelevantTo("double_child")))
+	assert.NoError(t, c.Set("double_child", "stale"))
+	assert.NoError(t, c.Set("double_canceled", "kept"))
+	assert.Equal(t, 1, c.CancelDoubleDelete("double_canceled"))
+
+	assert.Eventually(t, func() bool {
+		_, err := c.Get("double_child")
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	_, err := c.Get("double_canceled")
+	assert.NoError(t, err)
+	assert.Equal(t, rc.DoubleDeleteStats{
+		Scheduled: 2,
+		Executed:  1,
+		Canceled:  1,
+	}, c.DoubleDeleteStats())
+}
+
+func TestMemoryCacheHashRelevance(t *testing.T) {
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	assert.NoError(t, c.HSet(rc.NewItem("hash_profile").RelevantTo("hash_child"), "name", "john"))
+	assert.NoError(t, c.HSet("hash_profile", "age", "20"))
+	assert.NoError(t, c.Set("hash_child", "child"))
+	assert.NoError(t, c.Set(rc.NewItem("hash_view").Value("view").DependsOn("hash_profile")))
+	assert.NoError(t, c.Set(rc.NewItem("hash_root").Value("root").CascadeTo(rc.CascadeStale, "hash_profile")))
+
+	n, err := c.HLen("hash_profile")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	_, err = c.HGet("hash_profile", "__rc:meta")
+	assert.Equal(t, rc.ErrReservedHashField, err)
+	assert.Equal(t, rc.ErrReservedHashField, c.HSet("hash_profile", "__rc:meta", "v"))
+
+	// Hash is deleted instead of being marked as stale, and cascades like a string record
+	assert.NoError(t, c.Del("hash_root"))
+	for _, k := range []string{"hash_root", "hash_child", "hash_view"} {
+		_, err := c.Get(k)
+		assert.Error(t, err, k)
+	}
+	_, err = c.HGet("hash_profile", "name")
+	assert.Equal(t, rc.RedisNil, err)
+}
@@ -0,0 +1,278 @@
+package relevantcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Record format which is written by each version
+type Format int
+
+const (
+	// ![relevant keys joined with comma]@[split keys]@[data], described in README of early versions.
+	// Split keys were never used, so only records with empty split keys are detected
+	FormatReadme Format = iota + 1
+	// [$][\0][keys length (2 bytes)][keys joined with delimiter][data]
+	FormatLegacy
+	// [magic "$rc"][version 2][flags][keys][sections...][data], current format
+	FormatV2
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatReadme:
+		return "readme"
+	case FormatLegacy:
+		return "legacy"
+	case FormatV2:
+		return "v2"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(f))
+	}
+}
+
+// Parse format name which is returned by Format.String()
+func ParseFormat(name string) (Format, error) {
+	for _, f := range []Format{FormatReadme, FormatLegacy, FormatV2} {
+		if f.String() == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record format: %s", name)
+}
+
+// Key which is not migrated and its reason
+type MigrationSkip struct {
+	Key    string
+	Reason string
+}
+
+// Key which is failed to migrate
+type MigrationError struct {
+	Key string
+	Err error
+}
+
+// Result of migration, also passed to progress function after each batch
+type MigrationReport struct {
+	// Count of scanned keys
+	Scanned int
+	// Count of rewritten keys. On dry run, count of keys which would be rewritten
+	Migrated int
+	// Count of keys which are not stored in source format, e.g. primitive values
+	Unmatched int
+	// Keys which are stored in source format but could not be converted
+	Skipped []MigrationSkip
+	Errors  []MigrationError
+}
+
+// Backend which can be migrated
+type recordStore interface {
+	// Scan keys as SCAN command. Returns next cursor, 0 means end of iteration
+	scanKeys(cursor uint64, match string, count int64) ([]string, uint64, error)
+	// Rewrite stored record atomically with keeping TTL
+	rewriteRecord(key string, fn func(dat []byte) ([]byte, error)) error
+}
+
+// Skip reason of the record which can't be migrated
+type migrationSkip string
+
+func (m migrationSkip) Error() string {
+	return string(m)
+}
+
+// Returned by rewriting function when record is not stored in source format
+const errMigrationUnmatched = migrationSkip("record is not stored in source format")
+
+type migrateOptions struct {
+	match     string
+	batchSize int64
+	dryRun    bool
+	progress  func(MigrationReport)
+}
+
+// Migrate records in the cache from a format to another format.
+// All keys are scanned by SCAN command (or equivalent for MemoryCache) and records which are stored in from format are rewritten in to format.
+// TTLs are kept, and records which are modified while rewriting are retried on Redis.
+// Record data is kept as it is, so options like compression are not applied to migrated records.
+//
+// Currently enabled options are:
+//
+// rc.WithMigrationMatch(string): Pattern of keys to migrate, default is "*"
+// rc.WithMigrationBatchSize(int64): Count hint of SCAN command, default is 100
+// rc.WithMigrationDryRun(bool): Only report without rewriting
+// rc.WithMigrationProgress(func(MigrationReport)): Called after each batch
+func Migrate(ctx context.Context, c Cache, from, to Format, opts ...option) (*MigrationReport, error) {
+	store, ok := c.(recordStore)
+	if !ok {
+		return nil, fmt.Errorf("cache %T doesn't support migration", c)
+	}
+	if from == to {
+		return nil, fmt.Errorf("source and destination format are the same: %s", from)
+	}
+	switch from {
+	case FormatReadme, FormatLegacy, FormatV2:
+	default:
+		return nil, fmt.Errorf("unsupported source format: %s", from)
+	}
+	if to != FormatLegacy && to != FormatV2 {
+		return nil, fmt.Errorf("unsupported destination format: %s", to)
+	}
+
+	mo := migrateOptions{
+		match:     "*",
+		batchSize: 100,
+	}
+	for _, o := range opts {
+		switch o.name {
+		case optionNameMigrationMatch:
+			mo.match = o.value.(string)
+		case optionNameMigrationBatchSize:
+			mo.batchSize = o.value.(int64)
+		case optionNameMigrationDryRun:
+			mo.dryRun = o.value.(bool)
+		case optionNameMigrationProgress:
+			mo.progress = o.value.(func(MigrationReport))
+		}
+	}
+
+	report := &MigrationReport{}
+	var cursor uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		keys, next, err := store.scanKeys(cursor, mo.match, mo.batchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, key := range keys {
+			report.Scanned++
+			err := store.rewriteRecord(key, func(dat []byte) ([]byte, error) {
+				converted, err := convertRecord(dat, from, to)
+				if err != nil || mo.dryRun {
+					// Returning nil leaves the record as it is
+					return nil, err
+				}
+				return converted, nil
+			})
+			switch t := err.(type) {
+			case nil:
+				report.Migrated++
+			case migrationSkip:
+				if t == errMigrationUnmatched {
+					report.Unmatched++
+				} else {
+					report.Skipped = append(report.Skipped, MigrationSkip{Key: key, Reason: t.Error()})
+				}
+			default:
+				report.Errors = append(report.Errors, MigrationError{Key: key, Err: err})
+			}
+		}
+		if mo.progress != nil {
+			mo.progress(*report)
+		}
+		if next == 0 {
+			return report, nil
+		}
+		cursor = next
+	}
+}
+
+// Convert stored record from a format to another format.
+// Returns migrationSkip when record can't be converted.
+func convertRecord(dat []byte, from, to Format) ([]byte, error) {
+	var keys []string
+	var data []byte
+
+	switch from {
+	case FormatReadme:
+		if !isReadmeRecord(dat) {
+			return nil, errMigrationUnmatched
+		}
+		keys, data = decodeReadmeRecord(dat)
+	case FormatLegacy, FormatV2:
+		if (from == FormatLegacy) != isLegacyRecord(dat) || (from == FormatV2) != bytes.HasPrefix(dat, []byte(recordMagic)) {
+			return nil, errMigrationUnmatched
+		}
+		r, err := decodeRecord(dat)
+		if err != nil {
+			return nil, migrationSkip(fmt.Sprintf("broken record: %s", err.Error()))
+		}
+		if to == FormatLegacy && r.flags&^(flagKeyList|legacyDroppableMeta(r)) != 0 {
+			return nil, migrationSkip("record has sections which legacy format can't hold")
+		}
+		if keys, err = r.relevantKeys(); err != nil {
+			return nil, migrationSkip(fmt.Sprintf("broken relevant keys: %s", err.Error()))
+		}
+		data = r.data
+	}
+
+	switch to {
+	case FormatLegacy:
+		return encodeLegacyRecord(keys, data)
+	default:
+		r := newRecord(nil, data)
+		if len(keys) > 0 {
+			r.setRelevantKeys(keys)
+		}
+		return r.encode(), nil
+	}
+}
+
+// Meta section which has only created time is dropped on migrating to legacy format, returns 0 for other sections
+func legacyDroppableMeta(r *record) uint64 {
+	s := r.section(flagMeta)
+	if s == nil {
+		return 0
+	}
+	m, err := decodeItemMeta(s)
+	if err != nil || m.version != 0 || len(m.tags) > 0 || m.origin != "" {
+		return 0
+	}
+	return flagMeta
+}
+
+// Split keys were never used, so records in readme format always have empty split keys as ![keys]@@[data].
+// Other strings which start with "!" and contain "@" are not treated as records.
+func isReadmeRecord(dat []byte) bool {
+	if len(dat) == 0 || dat[0] != '!' {
+		return false
+	}
+	i := bytes.IndexByte(dat, '@')
+	return i > 0 && i+1 < len(dat) && dat[i+1] == '@'
+}
+
+// Decode ![keys]@@[data]
+func decodeReadmeRecord(dat []byte) ([]string, []byte) {
+	parts := bytes.SplitN(dat[1:], []byte("@"), 3)
+	var keys []string
+	for _, k := range strings.Split(string(parts[0]), ",") {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys, parts[2]
+}
+
+func encodeLegacyRecord(keys []string, data []byte) ([]byte, error) {
+	for _, k := range keys {
+		if strings.Contains(k, keyDelimiter) {
+			return nil, migrationSkip(fmt.Sprintf("relevant key %q contains delimiter", k))
+		}
+	}
+	keyStr := strings.Join(keys, keyDelimiter)
+	if len(keyStr) > 0xFFFF {
+		return nil, migrationSkip(fmt.Sprintf("relevant keys are too long for legacy format: %d bytes", len(keyStr)))
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 4+len(keyStr)+len(data)))
+	buf.WriteByte(signatureSign)
+	buf.WriteByte(nb)
+	binary.Write(buf, binary.BigEndian, uint16(len(keyStr)))
+	buf.WriteString(keyStr)
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
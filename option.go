@@ -2,6 +2,7 @@ package relevantcache
 
 import (
 	"io"
+	"time"
 )
 
 type option struct {
@@ -10,17 +11,39 @@ type option struct {
 }
 
 const (
-	//optionNameSplitBufferSize = "split_buffer_size"
-	optionNameSkipTLSVerify = "skip_tls_verify"
-	optionNameDebugWriter   = "debug_log"
+	optionNameSplitBufferSize = "split_buffer_size"
+	optionNameSkipTLSVerify   = "skip_tls_verify"
+	optionNameDebugWriter     = "debug_log"
+	optionNameCodec           = "codec"
+	optionNameCompression     = "compression"
+	optionNameChecksum        = "checksum"
+	optionNameOrigin          = "origin"
+	optionNameEncryption      = "encryption"
+
+	optionNameMaxRelevanceDepth = "max_relevance_depth"
+	optionNameAtomicDelete      = "atomic_delete"
+	optionNameExpiryCascade     = "expiry_cascade"
+	optionNameJanitorInterval   = "janitor_interval"
+	optionNameWildcardBudget    = "wildcard_budget"
+	optionNamePrefixIndex       = "prefix_index"
+	optionNameScheduleWorker    = "schedule_worker"
+	optionNameDoubleDelete      = "double_delete"
+
+	optionNameCorruptRecordPolicy = "corrupt_record_policy"
+
+	optionNameMigrationMatch     = "migration_match"
+	optionNameMigrationBatchSize = "migration_batch_size"
+	optionNameMigrationDryRun    = "migration_dry_run"
+	optionNameMigrationProgress  = "migration_progress"
 )
 
-// func WithSplitBufferSize(size int64) option {
-// 	return option{
-// 		name:  optionNameSplitBufferSize,
-// 		value: size,
-// 	}
-// }
+// Split record data which is larger than size bytes into chunk keys
+func WithSplitBufferSize(size int64) option {
+	return option{
+		name:  optionNameSplitBufferSize,
+		value: size,
+	}
+}
 
 func WithSkipTLSVerify(skip bool) option {
 	return option{
@@ -35,3 +58,178 @@ func WithDebugWriter(w io.Writer) option {
 		value: w,
 	}
 }
+
+// Set Codec to encode item values. Default is RawCodec
+func WithCodec(c Codec) option {
+	return option{
+		name:  optionNameCodec,
+		value: c,
+	}
+}
+
+type compressionOption struct {
+	algo    Compression
+	minSize int
+}
+
+// Compress record data which is larger than or equal to minSize bytes
+func WithCompression(algo Compression, minSize int) option {
+	return option{
+		name: optionNameCompression,
+		value: compressionOption{
+			algo:    algo,
+			minSize: minSize,
+		},
+	}
+}
+
+// Add checksum to records to detect corruption on reading
+func WithChecksum(enable bool) option {
+	return option{
+		name:  optionNameChecksum,
+		value: enable,
+	}
+}
+
+// Policy for corrupt records which are found on reading
+type CorruptRecordPolicy int
+
+const (
+	// Keep corrupt record as it is and return an error
+	CorruptRecordKeep CorruptRecordPolicy = iota
+	// Delete corrupt record and return an error
+	CorruptRecordDelete
+)
+
+// Set policy for corrupt records. Default is CorruptRecordKeep
+func WithCorruptRecordPolicy(policy CorruptRecordPolicy) option {
+	return option{
+		name:  optionNameCorruptRecordPolicy,
+		value: policy,
+	}
+}
+
+// Set name of the service which writes items. it's stored in item metadata
+func WithOrigin(name string) option {
+	return option{
+		name:  optionNameOrigin,
+		value: name,
+	}
+}
+
+// Encrypt record data by the current key of keyring.
+// Relevant keys and metadata in the record header are not encrypted so that relevant caches can be deleted without data keys.
+func WithEncryption(keyring *Keyring) option {
+	return option{
+		name:  optionNameEncryption,
+		value: keyring,
+	}
+}
+
+// Limit depth to follow relevant keys and dependents on deletion. Default is 64, and 0 means unlimited.
+// Relations over the depth are not followed and *RelevanceDepthError is returned.
+func WithMaxRelevanceDepth(depth int) option {
+	return option{
+		name:  optionNameMaxRelevanceDepth,
+		value: depth,
+	}
+}
+
+// Walk and delete relevant keys atomically by Lua script on redis. Default is false.
+// Checksum of records is not verified on the server, and it falls back to client-side walk when scripting is disabled.
+func WithAtomicDelete(enable bool) option {
+	return option{
+		name:  optionNameAtomicDelete,
+		value: enable,
+	}
+}
+
+// Delete relevant caches and dependents when records are expired by TTL as well as Del. Default is false.
+// On redis, expired events of keyspace notifications are subscribed, and notify-keyspace-events must include "E" and "x" or "A", e.g. "Ex" or "KEA".
+// The setting is checked but never changed, and ErrKeyspaceNotificationsDisabled is returned if it's not enabled.
+// On memory, expired records are deleted by background janitor.
+func WithExpiryCascade(enable bool) option {
+	return option{
+		name:  optionNameExpiryCascade,
+		value: enable,
+	}
+}
+
+// Set interval of janitor which deletes expired records on memory. Default is 1 second
+func WithJanitorInterval(interval time.Duration) option {
+	return option{
+		name:  optionNameJanitorInterval,
+		value: interval,
+	}
+}
+
+// Limit expansion of relevant keys with wildcard, e.g. RelevantAll.
+// Keys which are matched within budget are deleted, and *WildcardBudgetError is returned when expansion is stopped.
+func WithWildcardBudget(budget WildcardBudget) option {
+	return option{
+		name:  optionNameWildcardBudget,
+		value: budget,
+	}
+}
+
+// Maintain prefix index of keys on Set, so that relevant keys with wildcard are expanded
+// without scanning the keyspace. Only redis uses the index, and keys which are set before enabling it or by other clients
+// are not matched until they are indexed by RedisCache.BuildPrefixIndex.
+func WithPrefixIndex(enable bool) option {
+	return option{
+		name:  optionNamePrefixIndex,
+		value: enable,
+	}
+}
+
+// Run worker which deletes items scheduled by DelAt or DelAfter every interval on redis. Default is 0, not running.
+// The schedule is stored on redis, so any process which runs the worker deletes them, and each key is deleted by one of them.
+// Keys whose deletion fails are deleted again after a minute.
+// Memory cache deletes scheduled items by timers regardless of this option.
+func WithScheduleWorker(interval time.Duration) option {
+	return option{
+		name:  optionNameScheduleWorker,
+		value: interval,
+	}
+}
+
+// Delete items of Del and Unlink again after delay, known as delayed double delete.
+// It deletes stale data which concurrent readers write back while the source is updated. Default is 0, disabled.
+func WithDoubleDelete(delay time.Duration) option {
+	return option{
+		name:  optionNameDoubleDelete,
+		value: delay,
+	}
+}
+
+// Migrate only keys which match pattern. Pattern is the same as SCAN command
+func WithMigrationMatch(pattern string) option {
+	return option{
+		name:  optionNameMigrationMatch,
+		value: pattern,
+	}
+}
+
+// Set count hint of SCAN command on migration
+func WithMigrationBatchSize(size int64) option {
+	return option{
+		name:  optionNameMigrationBatchSize,
+		value: size,
+	}
+}
+
+// Only report migration result without rewriting records
+func WithMigrationDryRun(dryRun bool) option {
+	return option{
+		name:  optionNameMigrationDryRun,
+		value: dryRun,
+	}
+}
+
+// Set function which receives migration progress after each batch
+func WithMigrationProgress(fn func(MigrationReport)) option {
+	return option{
+		name:  optionNameMigrationProgress,
+		value: fn,
+	}
+}
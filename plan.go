@@ -0,0 +1,112 @@
+package relevantcache
+
+// Kind of the edge which leads to a key on invalidation
+type EdgeKind int
+
+const (
+	// Key is listed in relevant keys of the record
+	EdgeRelevant EdgeKind = iota + 1
+	// Key depends on the record
+	EdgeDependent
+	// Key is a chunk of the split record
+	EdgeChunk
+	// Key is the reverse dependency index of the record, only on redis
+	EdgeIndex
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case EdgeRelevant:
+		return "relevant"
+	case EdgeDependent:
+		return "dependent"
+	case EdgeChunk:
+		return "chunk"
+	case EdgeIndex:
+		return "index"
+	default:
+		return "unknown"
+	}
+}
+
+// Edge which leads to a key on invalidation
+type InvalidationEdge struct {
+	// Key which leads to To. It's empty when To is matched by the pattern which is given as root
+	From string
+	To   string
+	Kind EdgeKind
+	// Pattern which To is matched by. It's empty unless To is found by wildcard expansion
+	Pattern string
+}
+
+// Keys which would be deleted by Del or Unlink, and edges which lead to them
+type InvalidationPlan struct {
+	// Keys which are given, including patterns
+	Roots []string
+	// Keys which would be deleted, in order of found
+	Keys []string
+	// Edges which lead to keys, in order of found
+	Edges []InvalidationEdge
+	// Actions of keys which would be kept with other actions than delete, key is cache key
+	Actions map[string]CascadeAction
+	// Expansions of relevant keys with wildcard, in order of expanded
+	Expansions []WildcardExpansion
+}
+
+func newInvalidationPlan(roots, keys []string, w *walkState) *InvalidationPlan {
+	p := &InvalidationPlan{
+		Roots:      roots,
+		Keys:       []string{},
+		Edges:      []InvalidationEdge{},
+		Actions:    map[string]CascadeAction{},
+		Expansions: append([]WildcardExpansion{}, w.expansions...),
+	}
+	// Kept records which are reached again with delete action are deleted
+	for _, key := range w.keptKeys {
+		if k := w.kept[key]; k.action == CascadeDelete {
+			keys = append(append(keys, key), k.chunks...)
+		} else {
+			p.Actions[key] = k.action
+		}
+	}
+	found := map[string]struct{}{}
+	for _, k := range keys {
+		if _, ok := found[k]; ok {
+			continue
+		}
+		found[k] = struct{}{}
+		p.Keys = append(p.Keys, k)
+	}
+	// Edges to dependents which no longer depend on the parent are not followed
+	for _, e := range w.edges {
+		if _, ok := found[e.To]; ok || w.isVisited(e.To) {
+			p.Edges = append(p.Edges, e)
+		}
+	}
+	return p
+}
+
+// Get edges which lead to key
+func (p *InvalidationPlan) EdgesTo(key string) []InvalidationEdge {
+	edges := []InvalidationEdge{}
+	for _, e := range p.Edges {
+		if e.To == key {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
+// Get keys which are found by wildcard expansion
+func (p *InvalidationPlan) WildcardKeys() []string {
+	keys := []string{}
+	found := map[string]struct{}{}
+	for _, e := range p.Edges {
+		if _, ok := found[e.To]; ok || e.Pattern == "" {
+			continue
+		}
+		found[e.To] = struct{}{}
+		keys = append(keys, e.To)
+	}
+	return keys
+}
@@ -0,0 +1,381 @@
+package relevantcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Record format
+//
+// Current records (version 2) are stored as:
+//
+//	[magic "$rc"][version][flags (uvarint)][keys length (uvarint)][keys][sections...][data]
+//
+// keys is a list of [count (uvarint)]([key length (uvarint)][key])... when flagKeyList is set,
+// otherwise keys are joined with keyDelimiter.
+//
+// Each bit in flags declares an optional section which is placed after keys in ascending bit order.
+// A section is always [section length (uvarint)][section bytes], so readers can skip sections they don't know.
+//
+// Legacy records (version 1) which were written before version 2 are:
+//
+//	[$][\0][keys length (2 bytes)][keys][data]
+//
+// We still decode legacy records so that existing data keeps working.
+const (
+	recordMagic         = "$rc"
+	recordVersionLegacy = byte(1)
+	recordVersion       = byte(2)
+)
+
+// Flags of optional sections
+const (
+	flagCodec = uint64(1) << iota
+	flagCompression
+	flagChunks
+	flagChecksum
+	flagKeyList
+	flagMeta
+	flagEncryption
+	flagDepends
+	flagCascade
+	flagStale
+	flagWildcard
+)
+
+// Checksum algorithms
+const (
+	// CRC32C of header then data
+	checksumCRC32C = byte(1)
+	// CRC32C of data then header, used by streamed records whose header is fixed after data
+	checksumCRC32CDataFirst = byte(2)
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Decoded record
+type record struct {
+	version  byte
+	flags    uint64
+	keys     []byte
+	sections map[uint64][]byte
+	data     []byte
+}
+
+func newRecord(keys []byte, data []byte) *record {
+	return &record{
+		version:  recordVersion,
+		keys:     keys,
+		sections: map[uint64][]byte{},
+		data:     data,
+	}
+}
+
+// Get optional section for flag. returns nil if flag is not set
+func (r *record) section(flag uint64) []byte {
+	if r.flags&flag == 0 {
+		return nil
+	}
+	return r.sections[flag]
+}
+
+// Set relevant keys as length-prefixed list so that keys can contain any bytes
+func (r *record) setRelevantKeys(keys []string) {
+	r.keys = encodeKeyList(keys)
+	r.setSection(flagKeyList, []byte{})
+}
+
+// List relevant keys.
+// Records which don't have key list flag join keys with delimiter.
+func (r *record) relevantKeys() ([]string, error) {
+	if len(r.keys) == 0 {
+		return nil, nil
+	}
+	if r.flags&flagKeyList == 0 {
+		return strings.Split(string(r.keys), keyDelimiter), nil
+	}
+	return decodeKeyList(r.keys)
+}
+
+// List chunk keys if record data is split
+func (r *record) chunkKeys() ([]string, error) {
+	s := r.section(flagChunks)
+	if s == nil {
+		return nil, nil
+	}
+	return decodeKeyList(s)
+}
+
+// List keys which the record depends on
+func (r *record) dependsKeys() ([]string, error) {
+	s := r.section(flagDepends)
+	if s == nil {
+		return nil, nil
+	}
+	return decodeKeyList(s)
+}
+
+// Report whether the record depends on parent key
+func (r *record) dependsOn(parent string) bool {
+	keys, err := r.dependsKeys()
+	if err != nil {
+		return false
+	}
+	for _, k := range keys {
+		if k == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether relevant key is a wildcard pattern.
+// Records which don't have wildcard section treat keys which contain asterisk sign as patterns.
+func (r *record) isWildcard(key string) bool {
+	s := r.section(flagWildcard)
+	if s == nil {
+		return strings.Contains(key, "*")
+	}
+	keys, err := decodeKeyList(s)
+	if err != nil {
+		return strings.Contains(key, "*")
+	}
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether the record has the tag in metadata
+func (r *record) hasTag(tag string) bool {
+	for _, t := range r.tags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Write header fields which are covered by checksum.
+// Checksum section itself and stale section are excluded, so that the record can be marked as stale without data.
+func (r *record) writeDigestHeader(w io.Writer) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(r.version)
+	writeUvarint(buf, r.flags&^flagStale)
+	writeUvarint(buf, uint64(len(r.keys)))
+	buf.Write(r.keys)
+	for bit := uint(0); bit < 64; bit++ {
+		flag := uint64(1) << bit
+		if r.flags&flag == 0 || flag == flagChecksum || flag == flagStale {
+			continue
+		}
+		writeUvarint(buf, uint64(len(r.sections[flag])))
+		buf.Write(r.sections[flag])
+	}
+	w.Write(buf.Bytes())
+}
+
+// Calculate checksum of the record and its data
+func (r *record) digest(algo byte, data ...[]byte) uint32 {
+	h := crc32.New(crc32cTable)
+	if algo == checksumCRC32C {
+		r.writeDigestHeader(h)
+	}
+	for _, d := range data {
+		h.Write(d)
+	}
+	if algo == checksumCRC32CDataFirst {
+		r.writeDigestHeader(h)
+	}
+	return h.Sum32()
+}
+
+// Set checksum section for data
+func (r *record) setChecksum(algo byte, data ...[]byte) {
+	r.flags |= flagChecksum
+	s := make([]byte, 5)
+	s[0] = algo
+	binary.BigEndian.PutUint32(s[1:], r.digest(algo, data...))
+	r.setSection(flagChecksum, s)
+}
+
+// Get checksum algorithm and expected sum. ok is false if record doesn't have checksum
+func (r *record) checksum() (algo byte, sum uint32, ok bool, err error) {
+	s := r.section(flagChecksum)
+	if s == nil {
+		return 0, 0, false, nil
+	}
+	if len(s) != 5 || (s[0] != checksumCRC32C && s[0] != checksumCRC32CDataFirst) {
+		return 0, 0, false, fmt.Errorf("unsupported checksum section")
+	}
+	return s[0], binary.BigEndian.Uint32(s[1:]), true, nil
+}
+
+// Verify data with checksum. record which doesn't have checksum always passes
+func (r *record) verifyChecksum(data ...[]byte) error {
+	algo, expect, ok, err := r.checksum()
+	if err != nil || !ok {
+		return err
+	}
+	if actual := r.digest(algo, data...); expect != actual {
+		return fmt.Errorf("checksum mismatch: expected %08x, actual %08x", expect, actual)
+	}
+	return nil
+}
+
+// Set optional section for flag
+func (r *record) setSection(flag uint64, b []byte) {
+	r.flags |= flag
+	r.sections[flag] = b
+}
+
+// Encode record to byte slice as version 2
+func (r *record) encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(recordMagic)+len(r.keys)+len(r.data)+16))
+	buf.WriteString(recordMagic)
+	buf.WriteByte(recordVersion)
+	writeUvarint(buf, r.flags)
+	writeUvarint(buf, uint64(len(r.keys)))
+	buf.Write(r.keys)
+	for bit := uint(0); bit < 64; bit++ {
+		flag := uint64(1) << bit
+		if r.flags&flag == 0 {
+			continue
+		}
+		s := r.sections[flag]
+		writeUvarint(buf, uint64(len(s)))
+		buf.Write(s)
+	}
+	buf.Write(r.data)
+	return buf.Bytes()
+}
+
+// Decode record from stored data.
+// Returns nil record without error when data doesn't have any header (e.g. stored as primitive value).
+func decodeRecord(dat []byte) (*record, error) {
+	switch {
+	case isLegacyRecord(dat):
+		return decodeLegacyRecord(dat)
+	case bytes.HasPrefix(dat, []byte(recordMagic)):
+		return decodeRecordV2(dat)
+	default:
+		return nil, nil
+	}
+}
+
+func isLegacyRecord(dat []byte) bool {
+	return len(dat) > 2 && dat[0] == signatureSign && dat[1] == nb
+}
+
+func decodeLegacyRecord(dat []byte) (*record, error) {
+	if len(dat) < 4 {
+		return nil, fmt.Errorf("legacy record is too short: %d bytes", len(dat))
+	}
+	size := int(binary.BigEndian.Uint16(dat[2:4]))
+	if len(dat) < 4+size {
+		return nil, fmt.Errorf("legacy record keys overflow: %d bytes declared, %d bytes remain", size, len(dat)-4)
+	}
+	return &record{
+		version:  recordVersionLegacy,
+		keys:     dat[4 : 4+size],
+		sections: map[uint64][]byte{},
+		data:     dat[4+size:],
+	}, nil
+}
+
+func decodeRecordV2(dat []byte) (*record, error) {
+	p := len(recordMagic)
+	if len(dat) <= p {
+		return nil, fmt.Errorf("record is too short: %d bytes", len(dat))
+	}
+	r := &record{
+		version:  dat[p],
+		sections: map[uint64][]byte{},
+	}
+	if r.version != recordVersion {
+		return nil, fmt.Errorf("unsupported record version: %d", r.version)
+	}
+	p++
+
+	var err error
+	if r.flags, p, err = readUvarint(dat, p); err != nil {
+		return nil, err
+	}
+	if r.keys, p, err = readChunk(dat, p); err != nil {
+		return nil, err
+	}
+	for bit := uint(0); bit < 64; bit++ {
+		flag := uint64(1) << bit
+		if r.flags&flag == 0 {
+			continue
+		}
+		if r.sections[flag], p, err = readChunk(dat, p); err != nil {
+			return nil, err
+		}
+	}
+	r.data = dat[p:]
+	return r, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+func readUvarint(dat []byte, p int) (uint64, int, error) {
+	v, n := binary.Uvarint(dat[p:])
+	if n <= 0 {
+		return 0, p, fmt.Errorf("invalid varint at offset %d", p)
+	}
+	return v, p + n, nil
+}
+
+// Read length-prefixed bytes
+func readChunk(dat []byte, p int) ([]byte, int, error) {
+	size, p, err := readUvarint(dat, p)
+	if err != nil {
+		return nil, p, err
+	}
+	if size > uint64(len(dat)-p) {
+		return nil, p, fmt.Errorf("length %d overflows record at offset %d", size, p)
+	}
+	end := p + int(size)
+	return dat[p:end], end, nil
+}
+
+// Encode key list as [count (uvarint)]([key length (uvarint)][key])...
+func encodeKeyList(keys []string) []byte {
+	buf := new(bytes.Buffer)
+	writeUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		writeUvarint(buf, uint64(len(k)))
+		buf.WriteString(k)
+	}
+	return buf.Bytes()
+}
+
+func decodeKeyList(b []byte) ([]string, error) {
+	count, p, err := readUvarint(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(b)) {
+		return nil, fmt.Errorf("key list count %d overflows %d bytes", count, len(b))
+	}
+	keys := make([]string, 0, int(count))
+	for i := uint64(0); i < count; i++ {
+		var k []byte
+		if k, p, err = readChunk(b, p); err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(k))
+	}
+	return keys, nil
+}
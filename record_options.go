@@ -0,0 +1,364 @@
+package relevantcache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Options which affect encoding and decoding records, shared by all cache backends
+type recordOptions struct {
+	codec           Codec
+	compression     Compression
+	compressMinSize int
+	splitBufferSize int64
+	checksum        bool
+	corruptPolicy   CorruptRecordPolicy
+	origin          string
+	keyring         *Keyring
+}
+
+func newRecordOptions() *recordOptions {
+	return &recordOptions{
+		codec:       RawCodec,
+		compression: CompressionNone,
+	}
+}
+
+// Apply option if it's for records, and report whether applied or not
+func (o *recordOptions) apply(opt option) bool {
+	switch opt.name {
+	case optionNameCodec:
+		o.codec = opt.value.(Codec)
+	case optionNameCompression:
+		c := opt.value.(compressionOption)
+		o.compression = c.algo
+		o.compressMinSize = c.minSize
+	case optionNameSplitBufferSize:
+		o.splitBufferSize = opt.value.(int64)
+	case optionNameChecksum:
+		o.checksum = opt.value.(bool)
+	case optionNameCorruptRecordPolicy:
+		o.corruptPolicy = opt.value.(CorruptRecordPolicy)
+	case optionNameOrigin:
+		o.origin = opt.value.(string)
+	case optionNameEncryption:
+		o.keyring = opt.value.(*Keyring)
+	default:
+		return false
+	}
+	return true
+}
+
+// Split data of the record
+type chunk struct {
+	key  string
+	data []byte
+}
+
+// Fetch chunk data by keys. missing chunk should be nil
+type chunkFetcher func(keys []string) ([][]byte, error)
+
+func chunkKey(key string, index int) string {
+	return fmt.Sprintf("%s:chunk:%d", key, index)
+}
+
+// Report whether key looks like a chunk key which is made by chunkKey
+func isChunkKey(key string) bool {
+	i := strings.LastIndex(key, ":chunk:")
+	if i < 0 || i+len(":chunk:") == len(key) {
+		return false
+	}
+	for _, c := range key[i+len(":chunk:"):] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func chunkKeyList(chunks []chunk) []string {
+	keys := make([]string, len(chunks))
+	for i, c := range chunks {
+		keys[i] = c.key
+	}
+	return keys
+}
+
+// Report whether primitive value needs to be stored as record
+func (o *recordOptions) wrapsValue(size int) bool {
+	if o.checksum || o.keyring != nil || (o.compression != CompressionNone && size >= o.compressMinSize) {
+		return true
+	}
+	return o.splitBufferSize > 0 && int64(size) > o.splitBufferSize
+}
+
+// Encode *Item to the record
+func (o *recordOptions) encodeItem(item *Item) ([]byte, []chunk, error) {
+	r, err := item.toRecord(o.codec, o.origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.finalize(item.cacheKey(), r)
+}
+
+// Encode primitive value which is stored without metadata.
+// string and []byte are stored as they are, others are marshaled by cache codec.
+// If value is marshaled by other codec than RawCodec, or needs some transformation like compression,
+// value is stored as the record which doesn't have relevant keys so that the codec is recorded in the header.
+func (o *recordOptions) encodeValue(key string, value interface{}) ([]byte, []chunk, error) {
+	var data []byte
+	var marshaled bool
+	switch t := value.(type) {
+	case string:
+		data = []byte(t)
+	case []byte:
+		data = t
+	default:
+		b, err := o.codec.Marshal(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = b
+		marshaled = o.codec.ID() != codecIDRaw
+	}
+	if !marshaled && !o.wrapsValue(len(data)) {
+		return data, nil, nil
+	}
+	r := newRecord(nil, data)
+	if marshaled {
+		r.setSection(flagCodec, []byte{o.codec.ID()})
+	}
+	return o.finalize(key, r)
+}
+
+func (o *recordOptions) finalize(key string, r *record) ([]byte, []chunk, error) {
+	if err := o.seal(key, r); err != nil {
+		return nil, nil, err
+	}
+	chunks := o.split(key, r)
+	if o.checksum {
+		data := [][]byte{r.data}
+		for _, c := range chunks {
+			data = append(data, c.data)
+		}
+		r.setChecksum(checksumCRC32C, data...)
+	}
+	return r.encode(), chunks, nil
+}
+
+// Transform record data after encoding, compression then encryption
+func (o *recordOptions) seal(key string, r *record) error {
+	if o.compression != CompressionNone && len(r.data) >= o.compressMinSize {
+		data, err := compress(o.compression, r.data)
+		if err != nil {
+			return err
+		}
+		r.data = data
+		r.setSection(flagCompression, []byte{byte(o.compression)})
+	}
+	if o.keyring != nil {
+		return o.encrypt(key, r)
+	}
+	return nil
+}
+
+// Split record data into chunks when data is larger than split buffer size.
+// Chunk keys are recorded in the record and data is moved to chunks.
+func (o *recordOptions) split(key string, r *record) []chunk {
+	if o.splitBufferSize <= 0 || int64(len(r.data)) <= o.splitBufferSize {
+		return nil
+	}
+	size := int(o.splitBufferSize)
+	chunks := make([]chunk, 0, (len(r.data)+size-1)/size)
+	keys := make([]string, 0, cap(chunks))
+	for i := 0; i*size < len(r.data); i++ {
+		end := (i + 1) * size
+		if end > len(r.data) {
+			end = len(r.data)
+		}
+		k := chunkKey(key, i)
+		chunks = append(chunks, chunk{key: k, data: r.data[i*size : end]})
+		keys = append(keys, k)
+	}
+	r.data = nil
+	r.setSection(flagChunks, encodeKeyList(keys))
+	return chunks
+}
+
+// Restore original data from record which is transformed by seal() and split().
+// Broken record is reported as *CorruptRecordError
+func (o *recordOptions) open(key string, r *record, fetch chunkFetcher) ([]byte, error) {
+	data := r.data
+	keys, err := r.chunkKeys()
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	}
+	if len(keys) > 0 {
+		chunks, err := fetch(keys)
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range chunks {
+			if c == nil {
+				return nil, corruptRecord(key, fmt.Errorf("chunk %s is missing", keys[i]))
+			}
+		}
+		data = bytes.Join(chunks, nil)
+	}
+	if err := r.verifyChecksum(data); err != nil {
+		return nil, corruptRecord(key, err)
+	}
+	if r.section(flagEncryption) != nil {
+		dr, err := o.openReader(key, r, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = ioutil.ReadAll(dr); err != nil {
+			return nil, err
+		}
+	}
+	if s := r.section(flagCompression); s != nil {
+		if len(s) != 1 {
+			return nil, corruptRecord(key, fmt.Errorf("invalid compression section: %d bytes", len(s)))
+		}
+		if data, err = decompress(Compression(s[0]), data); err != nil {
+			return nil, corruptRecord(key, err)
+		}
+	}
+	return data, nil
+}
+
+// Get actual data from stored data
+func (o *recordOptions) payload(key string, dat []byte, fetch chunkFetcher) ([]byte, error) {
+	r, err := decodeRecord(dat)
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	} else if r == nil {
+		return dat, nil
+	}
+	return o.open(key, r, fetch)
+}
+
+// Unmarshal stored data to dst with the codec which is recorded in the header.
+// If stored data doesn't have a header, use cache codec.
+func (o *recordOptions) unmarshal(key string, dat []byte, dst interface{}, fetch chunkFetcher) error {
+	r, err := decodeRecord(dat)
+	if err != nil {
+		return corruptRecord(key, err)
+	}
+	if r == nil {
+		return o.codec.Unmarshal(dat, dst)
+	}
+	codec := RawCodec
+	if s := r.section(flagCodec); s != nil {
+		if len(s) != 1 {
+			return corruptRecord(key, fmt.Errorf("invalid codec section: %d bytes", len(s)))
+		}
+		if codec, err = lookupCodec(s[0]); err != nil {
+			return err
+		}
+	}
+	data, err := o.open(key, r, fetch)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, dst)
+}
+
+// Decode record to walk relevant keys.
+// Checksum is verified only when record data is not split because we don't read chunks on walking.
+func (o *recordOptions) decodeForWalk(key string, dat []byte) (*record, error) {
+	r, err := decodeRecord(dat)
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	} else if r == nil {
+		return nil, nil
+	}
+	if r.section(flagChunks) == nil {
+		if err := r.verifyChecksum(r.data); err != nil {
+			return nil, corruptRecord(key, err)
+		}
+	}
+	return r, nil
+}
+
+// Make record header without data to resolve relevant keys after the record is expired.
+// Returns nil if the record doesn't have relevant keys.
+func shadowRecord(dat []byte) []byte {
+	r, err := decodeRecord(dat)
+	if err != nil || r == nil {
+		return nil
+	}
+	if keys, err := r.relevantKeys(); err != nil || len(keys) == 0 {
+		return nil
+	}
+	r.data = nil
+	return r.encode()
+}
+
+// Key which is bound to encrypted value of hash field
+func hashFieldKey(key, field string) string {
+	return fmt.Sprintf("%s[%s]", key, field)
+}
+
+// Encode value of hash field. Value is stored as it is unless encryption is enabled
+func (o *recordOptions) encodeField(key, field string, data []byte) ([]byte, error) {
+	if o.keyring == nil {
+		return data, nil
+	}
+	r := newRecord(nil, data)
+	if err := o.encrypt(hashFieldKey(key, field), r); err != nil {
+		return nil, err
+	}
+	return r.encode(), nil
+}
+
+// Decode value of hash field which is encoded by encodeField
+func (o *recordOptions) decodeField(key, field string, dat []byte) ([]byte, error) {
+	r, err := decodeRecord(dat)
+	if err != nil || r == nil || r.section(flagEncryption) == nil {
+		return dat, nil
+	}
+	// Hash field never has chunks
+	return o.open(hashFieldKey(key, field), r, func(keys []string) ([][]byte, error) {
+		return make([][]byte, len(keys)), nil
+	})
+}
+
+// List keys which should be deleted when corrupt record is found on reading
+func (o *recordOptions) corruptKeys(key string, dat []byte) []string {
+	if o.corruptPolicy != CorruptRecordDelete {
+		return nil
+	}
+	keys := []string{key}
+	if r, err := decodeRecord(dat); err == nil && r != nil {
+		chunkKeys, _ := r.chunkKeys()
+		keys = append(keys, chunkKeys...)
+	}
+	return keys
+}
+
+// List chunk keys which are stored by old record but not used by new record
+func staleChunkKeys(old []byte, usedKeys []string) []string {
+	r, err := decodeRecord(old)
+	if err != nil || r == nil {
+		return nil
+	}
+	keys, err := r.chunkKeys()
+	if err != nil {
+		return nil
+	}
+	used := make(map[string]struct{}, len(usedKeys))
+	for _, k := range usedKeys {
+		used[k] = struct{}{}
+	}
+	stale := []string{}
+	for _, k := range keys {
+		if _, ok := used[k]; !ok {
+			stale = append(stale, k)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,58 @@
+package relevantcache_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	rc "github.com/ysugimoto/relevantcache"
+)
+
+func TestRecordEncodeAndDecode(t *testing.T) {
+	keys, data, err := rc.DecodeRecord(rc.EncodeRecord("parent_1|parent_2", []byte("value")))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("parent_1|parent_2"), keys)
+	assert.Equal(t, []byte("value"), data)
+}
+
+func TestRecordEncodeAndDecodeWithLongKeys(t *testing.T) {
+	longKeys := strings.Repeat("parent_key|", 100)
+	keys, data, err := rc.DecodeRecord(rc.EncodeRecord(longKeys, []byte("value")))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(longKeys), keys)
+	assert.Equal(t, []byte("value"), data)
+}
+
+func TestRecordDecodeLegacyFormat(t *testing.T) {
+	legacy := append([]byte{'$', 0, 0, 8}, []byte("parent_1value")...)
+	keys, data, err := rc.DecodeRecord(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("parent_1"), keys)
+	assert.Equal(t, []byte("value"), data)
+}
+
+func TestRecordDecodePrimitiveValue(t *testing.T) {
+	keys, data, err := rc.DecodeRecord([]byte("value"))
+	assert.NoError(t, err)
+	assert.Nil(t, keys)
+	assert.Equal(t, []byte("value"), data)
+}
+
+func TestRecordDecodeTruncatedRecord(t *testing.T) {
+	b := rc.EncodeRecord("parent_1|parent_2", []byte("value"))
+	c := rc.NewMemoryCache()
+	defer c.Close()
+
+	// Truncate inside relevant keys
+	assert.NoError(t, c.Set("truncated", b[:10]))
+	_, err := c.Get("truncated")
+	assert.True(t, errors.Is(err, rc.ErrCorruptRecord))
+	_, err = c.Get("truncated")
+	assert.True(t, errors.Is(err, rc.ErrCorruptRecord))
+
+	// Legacy signature but keys length overflows
+	assert.NoError(t, c.Set("legacy", []byte{'$', 0, 0xFF, 0xFF, 'a'}))
+	_, err = c.Get("legacy")
+	assert.True(t, rc.IsCorruptRecord(err))
+}
@@ -1,10 +1,15 @@
 package relevantcache
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"crypto/tls"
@@ -17,8 +22,24 @@ var RedisNil = redis.Nil
 
 // Redis backend struct
 type RedisCache struct {
-	conn *redis.Client
-	w    io.Writer
+	conn     *redis.Client
+	w        io.Writer
+	opts     *recordOptions
+	maxDepth int
+	atomic   bool
+	budget   WildcardBudget
+	// Whether prefix index is maintained on Set and used to expand wildcard
+	prefixIndex bool
+	// Second deletion of Del and Unlink, nil if double delete is disabled
+	double *doubleDeleter
+
+	// Subscription of expired events for expiry cascade
+	expiryCascade bool
+	pubsub        *redis.PubSub
+	// Background workers are stopped by closing stop
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 func (r *RedisCache) Redis() *redis.Client {
@@ -29,17 +50,51 @@ func (r *RedisCache) Redis() *redis.Client {
 // Currently enabled options are:
 //
 // rc.WithSkipTLSVerify(bool): Skip TLS verification
+// rc.WithDebugWriter(io.Writer): Write debug messages
+// rc.WithCodec(Codec): Codec to encode item values
+// rc.WithCompression(Compression, int): Compress large record data
+// rc.WithSplitBufferSize(int64): Split large record data into chunk keys
+// rc.WithChecksum(bool): Add checksum to detect corrupt records
+// rc.WithCorruptRecordPolicy(CorruptRecordPolicy): Whether corrupt records are deleted on reading
+// rc.WithOrigin(string): Name of the service which writes items
+// rc.WithEncryption(*Keyring): Encrypt record data
+// rc.WithMaxRelevanceDepth(int): Limit of depth to follow relevant keys and dependents
+// rc.WithAtomicDelete(bool): Walk and delete relevant keys atomically by Lua script
+// rc.WithExpiryCascade(bool): Delete relevant caches when records are expired
+// rc.WithWildcardBudget(WildcardBudget): Limit expansion of relevant keys with wildcard
+// rc.WithPrefixIndex(bool): Expand relevant keys with wildcard by prefix index instead of SCAN
+// rc.WithScheduleWorker(time.Duration): Delete items which are scheduled by DelAt or DelAfter
+// rc.WithDoubleDelete(time.Duration): Delete items again after delay on Del and Unlink
 func NewRedisCache(endpoint string, opts ...option) (*RedisCache, error) {
 	var skipVerify bool
 	var w io.Writer
+	var atomic, expiryCascade, prefixIndex bool
+	var budget WildcardBudget
+	var scheduleInterval, doubleDelay time.Duration
+	maxDepth := defaultMaxRelevanceDepth
+	ro := newRecordOptions()
 	for _, o := range opts {
 		switch o.name {
 		case optionNameSkipTLSVerify:
 			skipVerify = o.value.(bool)
-			// case optionNameSplitBufferSize:
-			// 	splitChunkSize = o.value.(int64)
 		case optionNameDebugWriter:
 			w = o.value.(io.Writer)
+		case optionNameMaxRelevanceDepth:
+			maxDepth = o.value.(int)
+		case optionNameAtomicDelete:
+			atomic = o.value.(bool)
+		case optionNameExpiryCascade:
+			expiryCascade = o.value.(bool)
+		case optionNameWildcardBudget:
+			budget = o.value.(WildcardBudget)
+		case optionNamePrefixIndex:
+			prefixIndex = o.value.(bool)
+		case optionNameScheduleWorker:
+			scheduleInterval = o.value.(time.Duration)
+		case optionNameDoubleDelete:
+			doubleDelay = o.value.(time.Duration)
+		default:
+			ro.apply(o)
 		}
 	}
 
@@ -66,14 +121,46 @@ func NewRedisCache(endpoint string, opts ...option) (*RedisCache, error) {
 	} else if pong != "PONG" {
 		return nil, fmt.Errorf("failed to receive PONG from server")
 	}
-	return &RedisCache{
-		conn: conn,
-		w:    w,
-	}, nil
+	r := &RedisCache{
+		conn:          conn,
+		w:             w,
+		opts:          ro,
+		maxDepth:      maxDepth,
+		atomic:        atomic,
+		budget:        budget,
+		prefixIndex:   prefixIndex,
+		expiryCascade: expiryCascade,
+		stop:          make(chan struct{}),
+	}
+	if doubleDelay > 0 {
+		r.double = newDoubleDeleter(doubleDelay, w, func(method string, keys ...interface{}) error {
+			_, err := r.invalidate(method, nil, keys...)
+			return err
+		})
+	}
+	if expiryCascade {
+		if err := r.subscribeExpired(options.DB); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if scheduleInterval > 0 {
+		r.wg.Add(1)
+		go r.scheduleWorker(scheduleInterval)
+	}
+	return r, nil
 }
 
-// Close connection
+// Stop background workers and close connection
 func (r *RedisCache) Close() error {
+	r.double.close()
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		if r.pubsub != nil {
+			r.pubsub.Close()
+		}
+	})
+	r.wg.Wait()
 	return r.conn.Close()
 }
 
@@ -93,13 +180,145 @@ func (r *RedisCache) Get(item interface{}) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	b, err := r.conn.Get(key).Bytes()
+	b, err := r.get(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.opts.payload(key, b, r.fetchChunks)
 	if err != nil {
+		r.dropCorruptRecord(key, b, err)
 		return nil, err
 	}
-	_, data := decodeMeta(b)
 	return data, nil
+}
+
+// Get cache and unmarshal to dst with the codec which the cache is encoded by
+func (r *RedisCache) GetValue(item interface{}, dst interface{}) error {
+	key, err := getKey(item)
+	if err != nil {
+		return err
+	}
+	b, err := r.get(key)
+	if err != nil {
+		return err
+	}
+	if err := r.opts.unmarshal(key, b, dst, r.fetchChunks); err != nil {
+		r.dropCorruptRecord(key, b, err)
+		return err
+	}
+	return nil
+}
+
+// Get cache even if it's marked as stale by cascading deletion, so that it can be served while refreshing.
+// stale reports whether the cache is marked as stale.
+func (r *RedisCache) GetStale(item interface{}) (data []byte, stale bool, err error) {
+	key, err := getKey(item)
+	if err != nil {
+		return nil, false, err
+	}
+	b, err := r.conn.Get(key).Bytes()
+	if err != nil {
+		return nil, false, err
+	}
+	if data, err = r.opts.payload(key, b, r.fetchChunks); err != nil {
+		r.dropCorruptRecord(key, b, err)
+		return nil, false, err
+	}
+	return data, isStaleRecord(b), nil
+}
+
+// GET stored record. Record which is marked as stale is treated as missing
+func (r *RedisCache) get(key string) ([]byte, error) {
+	b, err := r.conn.Get(key).Bytes()
+	if err == nil && isStaleRecord(b) {
+		return nil, redis.Nil
+	}
+	return b, err
+}
+
+// Delete corrupt record if policy is CorruptRecordDelete
+func (r *RedisCache) dropCorruptRecord(key string, dat []byte, err error) {
+	if !IsCorruptRecord(err) {
+		return
+	}
+	debug(r.w, fmt.Sprintf("[CORRUPT] %s\n", err.Error()))
+	if keys := r.opts.corruptKeys(key, dat); len(keys) > 0 {
+		if err := r.conn.Del(keys...).Err(); err != nil {
+			debug(r.w, fmt.Sprintf("[CORRUPT] failed to delete corrupt record %s, %s\n", key, err.Error()))
+		}
+	}
+}
+
+// Get cache with metadata which is stored in the record header
+func (r *RedisCache) GetWithMeta(item interface{}) (*Entry, error) {
+	key, err := getKey(item)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.get(key)
+	if err != nil {
+		return nil, err
+	}
+	e, err := r.opts.entry(key, b, r.fetchChunks)
+	if err != nil {
+		r.dropCorruptRecord(key, b, err)
+		return nil, err
+	}
+	return e, nil
+}
+
+// Get cache as stream. Record header is read first and data is read by GETRANGE or chunk keys on demand,
+// so whole data is never loaded into memory. Checksum is verified when stream reaches EOF.
+// Note that stream might read a record which is overwritten while reading, checksum option is recommended to detect it.
+func (r *RedisCache) GetStream(item interface{}) (io.ReadCloser, error) {
+	key, err := getKey(item)
+	if err != nil {
+		return nil, err
+	}
+	src := &redisRangeReader{conn: r.conn, key: key}
+	br := bufio.NewReaderSize(src, redisRangeSize)
+	rec, err := decodeRecordHeader(br)
+	if src.err != nil {
+		return nil, src.err
+	} else if err != nil {
+		err = corruptRecord(key, err)
+		r.dropCorruptRecord(key, nil, err)
+		return nil, err
+	} else if rec == nil {
+		return ioutil.NopCloser(br), nil
+	} else if rec.isStale() {
+		return nil, redis.Nil
+	}
+	rc, err := r.opts.openStream(key, rec, br, r.fetchChunk)
+	if err != nil {
+		r.dropCorruptRecord(key, nil, err)
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Get a chunk of split record
+func (r *RedisCache) fetchChunk(key string) ([]byte, error) {
+	b, err := r.conn.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return b, err
+}
 
+// Get chunks of split record
+func (r *RedisCache) fetchChunks(keys []string) ([][]byte, error) {
+	result, err := r.conn.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, len(keys))
+	for i, v := range result {
+		if v != nil {
+			chunks[i] = []byte(v.(string))
+		}
+	}
+	return chunks, nil
 }
 
 func (r *RedisCache) Dump() string {
@@ -116,6 +335,8 @@ func (r *RedisCache) Dump() string {
 func (r *RedisCache) Set(args ...interface{}) (err error) {
 	var key string
 	var value interface{}
+	var chunks []chunk
+	var depends, tags []string
 	var ttl int
 
 	switch len(args) {
@@ -127,8 +348,12 @@ func (r *RedisCache) Set(args ...interface{}) (err error) {
 			return fmt.Errorf("if and only one argument is supplied, it must be *Item")
 		}
 		key = item.cacheKey()
-		value = item.encode()
+		if value, chunks, err = r.opts.encodeItem(item); err != nil {
+			return err
+		}
 		ttl = int(item.ttl)
+		depends = item.getDependsKeys()
+		tags = item.tags
 		debug(r.w, fmt.Sprintf("[SET] cahce key %s is relevant to %q\n", key, item.getRelevaneKeys()))
 	case 2:
 		key = args[0].(string)
@@ -140,42 +365,418 @@ func (r *RedisCache) Set(args ...interface{}) (err error) {
 		ttl = args[2].(int)
 	}
 
+	// Other primitive values are formatted by redis client unless codec is specified
+	if len(args) > 1 {
+		switch value.(type) {
+		case string, []byte:
+			value, chunks, err = r.opts.encodeValue(key, value)
+		default:
+			if r.opts.codec.ID() != codecIDRaw {
+				value, chunks, err = r.opts.encodeValue(key, value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	var expire time.Duration
 	if ttl > 0 {
 		expire = time.Duration(ttl) * time.Second
 	}
-	return r.conn.Set(key, value, expire).Err()
+	if r.opts.splitBufferSize <= 0 && len(depends) == 0 && len(tags) == 0 && !r.expiryCascade && !r.prefixIndex {
+		return r.conn.Set(key, value, expire).Err()
+	}
+
+	write := func(pipe redis.Pipeliner, old []byte) {
+		if stale := staleChunkKeys(old, chunkKeyList(chunks)); len(stale) > 0 {
+			pipe.Del(stale...)
+		}
+		for _, c := range chunks {
+			pipe.Set(c.key, c.data, expire)
+		}
+		pipe.Set(key, value, expire)
+		indexDependent(pipe, key, depends, expire)
+		indexTags(pipe, key, tags, expire)
+		if r.expiryCascade {
+			setShadow(pipe, key, value, expire)
+		}
+		if r.prefixIndex {
+			indexPrefix(pipe, key, expire)
+		}
+	}
+	// Record might be split, so we need to remove chunks of old record which are no longer used
+	if r.opts.splitBufferSize > 0 {
+		return r.writeRecord(key, write)
+	}
+	_, err = r.conn.TxPipelined(func(pipe redis.Pipeliner) error {
+		write(pipe, nil)
+		return nil
+	})
+	return err
+}
+
+// Write record by fn in the transaction which watches key. old is the current record, or nil if it's missing.
+// Writing is retried if key is modified by others before the transaction, so that stale chunks of old record are never left.
+func (r *RedisCache) writeRecord(key string, fn func(pipe redis.Pipeliner, old []byte)) error {
+	write := func(tx *redis.Tx) error {
+		old, err := tx.Get(key).Bytes()
+		if err != nil && err != redis.Nil && !isWrongType(err) {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			fn(pipe, old)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.conn.Watch(write, key); err != redis.TxFailedErr {
+			return err
+		}
+		debug(r.w, fmt.Sprintf("[SET] %s is modified while writing, retry\n", key))
+	}
+	return redis.TxFailedErr
+}
+
+// Add key to reverse dependency index of each parent, or tag index of each tag.
+// Index is expired with the key which lives longest, and never expired if any key doesn't have TTL.
+var indexDependentScript = redis.NewScript(`
+local added = redis.call('SADD', KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+local current = redis.call('PTTL', KEYS[1])
+if ttl == 0 then
+	if current > 0 then
+		redis.call('PERSIST', KEYS[1])
+	end
+elseif current ~= -1 or redis.call('SCARD', KEYS[1]) == 1 then
+	if current < ttl then
+		redis.call('PEXPIRE', KEYS[1], ttl)
+	end
+end
+return added
+`)
+
+func indexDependent(pipe redis.Pipeliner, key string, parents []string, expire time.Duration) {
+	for _, p := range parents {
+		indexDependentScript.Eval(pipe, []string{dependentsKey(p)}, key, int64(expire/time.Millisecond))
+	}
+}
+
+func indexTags(pipe redis.Pipeliner, key string, tags []string, expire time.Duration) {
+	for _, t := range tags {
+		indexDependentScript.Eval(pipe, []string{tagKey(t)}, key, int64(expire/time.Millisecond))
+	}
+}
+
+// Add key to the prefix index. Expiration is tracked for key which has TTL so that it's pruned after key is expired
+func indexPrefix(pipe redis.Pipeliner, key string, expire time.Duration) {
+	pipe.ZAdd(prefixIndexKey, redis.Z{Member: key})
+	if expire > 0 {
+		expirePrefix(pipe, key, time.Now().Add(expire))
+	} else {
+		pipe.ZRem(prefixExpiryKey, key)
+	}
+}
+
+func expirePrefix(pipe redis.Pipeliner, key string, at time.Time) {
+	pipe.ZAdd(prefixExpiryKey, redis.Z{Score: float64(at.UnixNano() / int64(time.Millisecond)), Member: key})
+}
+
+// Prefix of temporary keys which chunks of SetStream are written to while reading.
+// They are renamed to chunk keys with the record in a transaction, so that readers never see new chunks with old record.
+const streamChunkKeyPrefix = "__rc:stream:"
+
+// Temporary chunks are expired after this duration if the writer exits before renaming them
+const streamChunkTTL = time.Hour
+
+func streamChunkKey(token, key string) string {
+	return streamChunkKeyPrefix + token + ":" + key
+}
+
+// Set cache from stream. Data is read by split buffer size and stored to temporary keys while reading,
+// then they are renamed to chunk keys and the record which has metadata is stored in a transaction,
+// so that readers never see incomplete record. Temporary keys are deleted if reading or writing fails.
+// Data which is fit in single chunk is stored in the record as well as Set.
+func (r *RedisCache) SetStream(item *Item, src io.Reader) error {
+	key := item.cacheKey()
+	var expire time.Duration
+	if item.ttl > 0 {
+		expire = time.Duration(item.ttl) * time.Second
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("%x", token)
+
+	temps := []string{}
+	rec, keys, err := r.opts.writeStream(item, src, func(c chunk) error {
+		temp := streamChunkKey(prefix, c.key)
+		temps = append(temps, temp)
+		return r.conn.Set(temp, c.data, streamChunkTTL).Err()
+	})
+	if err == nil {
+		debug(r.w, fmt.Sprintf("[SET] cahce key %s is relevant to %q, streamed into %d chunks\n", key, item.getRelevaneKeys(), len(keys)))
+		dat := rec.encode()
+		err = r.writeRecord(key, func(pipe redis.Pipeliner, old []byte) {
+			if stale := staleChunkKeys(old, keys); len(stale) > 0 {
+				pipe.Del(stale...)
+			}
+			for i, k := range keys {
+				pipe.Rename(temps[i], k)
+				if expire > 0 {
+					pipe.PExpire(k, expire)
+				} else {
+					pipe.Persist(k)
+				}
+			}
+			pipe.Set(key, dat, expire)
+			indexDependent(pipe, key, item.getDependsKeys(), expire)
+			indexTags(pipe, key, item.tags, expire)
+			if r.expiryCascade {
+				setShadow(pipe, key, dat, expire)
+			}
+			if r.prefixIndex {
+				indexPrefix(pipe, key, expire)
+			}
+		})
+	}
+	if err != nil && len(temps) > 0 {
+		if derr := r.conn.Del(temps...).Err(); derr != nil {
+			debug(r.w, fmt.Sprintf("[SET] failed to delete temporary chunks of %s, %s\n", key, derr.Error()))
+		}
+	}
+	return err
 }
 
 // Wrap of redis.DEL
 // item is acceptable either of string of *Item
+// If corrupt record is found on resolving relevant keys, it's deleted and *CorruptRecordError is returned.
 func (r *RedisCache) Del(items ...interface{}) error {
-	keys := r.factoryDeleteKeys("DEL", items...)
-	if len(keys) == 0 {
-		debug(r.w, "[DEL] delete relevant caches are empty. skipped\n")
-		return nil
-	}
-
-	debug(r.w, fmt.Sprintf("[DEL] delete relevant caches %q\n", keys))
-	return r.conn.Del(keys...).Err()
+	_, err := r.del("DEL", nil, items...)
+	return err
 }
 
 // Wrap of redis.UNLINK, note that ensure your redis engine is later than v4
 // item is acceptable either of string of *Item
 func (r *RedisCache) Unlink(items ...interface{}) error {
-	keys := r.factoryDeleteKeys("UNLINK", items...)
-	if len(keys) == 0 {
-		debug(r.w, "[UNLINK] delete relevant caches are empty. skipped\n")
+	_, err := r.del("UNLINK", nil, items...)
+	return err
+}
+
+// Same as Del, but also returns InvalidationResult which describes removed and missing keys, errors and expansions.
+// Returned error is the same as Del.
+func (r *RedisCache) DelWithResult(items ...interface{}) (*InvalidationResult, error) {
+	return r.del("DEL", newInvalidationResult(items), items...)
+}
+
+// Same as Unlink, but also returns InvalidationResult
+func (r *RedisCache) UnlinkWithResult(items ...interface{}) (*InvalidationResult, error) {
+	return r.del("UNLINK", newInvalidationResult(items), items...)
+}
+
+// Delete items by method, and schedule the second deletion if double delete is enabled
+func (r *RedisCache) del(method string, res *InvalidationResult, items ...interface{}) (*InvalidationResult, error) {
+	res, err := r.invalidate(method, res, items...)
+	r.double.schedule(method, items...)
+	return res, err
+}
+
+// Delete items by method. res is filled if it's not nil
+func (r *RedisCache) invalidate(method string, res *InvalidationResult, items ...interface{}) (*InvalidationResult, error) {
+	w := newWalkState(r.maxDepth, r.w)
+	if r.atomic {
+		if done, err := r.deleteAtomically(method, w, res, items...); done {
+			return finishResult(res, w), err
+		}
+	}
+	keys, walkErr := r.factoryDeleteKeys(method, w, items...)
+	if err := r.deleteKeys(method, keys, w, res); err != nil {
+		return finishResult(res, w), err
+	}
+	return finishResult(res, w), walkErr
+}
+
+// Cancel pending second deletions of double delete for items. Returns the count of canceled ones
+func (r *RedisCache) CancelDoubleDelete(items ...interface{}) int {
+	return r.double.cancel(items...)
+}
+
+// Get counts of second deletions of double delete
+func (r *RedisCache) DoubleDeleteStats() DoubleDeleteStats {
+	return r.double.stats()
+}
+
+// Resolve keys which would be deleted by Del or Unlink with edges which lead to them. Nothing is deleted.
+func (r *RedisCache) Resolve(items ...interface{}) (*InvalidationPlan, error) {
+	w := newWalkState(r.maxDepth, r.w)
+	w.trace = true
+	roots := r.rootKeys("RESOLVE", items...)
+	keys, err := r.walk(roots, w)
+	return newInvalidationPlan(roots, keys, w), err
+}
+
+// Walk and delete relevant keys by Lua script so that no record is written into the graph while deleting.
+// Returns false when the script can't be run, then caller should fall back to client-side walk.
+func (r *RedisCache) deleteAtomically(method string, w *walkState, res *InvalidationResult, items ...interface{}) (bool, error) {
+	roots := r.rootKeys(method, items...)
+	if len(roots) == 0 {
+		debug(r.w, fmt.Sprintf("[%s] delete relevant caches are empty. skipped\n", method))
+		return true, nil
+	}
+	keys, fallback, err := r.cascadeDelete(method, roots, w, res)
+	if fallback {
+		return false, nil
+	}
+	debug(r.w, fmt.Sprintf("[%s] deleted relevant caches atomically %q\n", method, keys))
+	return true, err
+}
+
+// Delete keys which are resolved by walking, and remove them from indexes.
+// When res is not nil, keys are deleted one by one to report whether each key is removed.
+func (r *RedisCache) deleteKeys(method string, keys []string, w *walkState, res *InvalidationResult) error {
+	keys = append(keys, w.keptDeletes()...)
+	if len(keys) == 0 && len(w.untag) == 0 && len(w.kept) == 0 {
+		debug(r.w, fmt.Sprintf("[%s] delete relevant caches are empty. skipped\n", method))
 		return nil
 	}
 
-	debug(r.w, fmt.Sprintf("[UNLINK] delete relevant caches %q\n", keys))
-	return r.conn.Unlink(keys...).Err()
+	debug(r.w, fmt.Sprintf("[%s] delete relevant caches %q\n", method, keys))
+	var cmds []*redis.IntCmd
+	_, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+		if res != nil {
+			cmds = make([]*redis.IntCmd, len(keys))
+			for i, k := range keys {
+				if method == "UNLINK" {
+					cmds[i] = pipe.Unlink(k)
+				} else {
+					cmds[i] = pipe.Del(k)
+				}
+			}
+		} else if len(keys) > 0 {
+			if method == "UNLINK" {
+				pipe.Unlink(keys...)
+			} else {
+				pipe.Del(keys...)
+			}
+		}
+		// Visited keys are deleted or missing unless they are kept
+		gone := make([]string, 0, len(w.visited))
+		for k := range w.visited {
+			if !w.isKept(k) {
+				gone = append(gone, k)
+			}
+		}
+		if r.expiryCascade && len(gone) > 0 {
+			shadows := make([]string, len(gone))
+			for i, k := range gone {
+				shadows[i] = shadowKey(k)
+			}
+			pipe.Del(shadows...)
+		}
+		if r.prefixIndex && len(gone) > 0 {
+			pipe.ZRem(prefixIndexKey, members(gone)...)
+			pipe.ZRem(prefixExpiryKey, members(gone)...)
+		}
+		r.applyCascadeActions(pipe, method, w)
+		unindexDependents(pipe, w)
+		return nil
+	})
+	if err != nil || res == nil {
+		return err
+	}
+	for i, k := range keys {
+		res.resolve(k, cmds[i].Val() > 0)
+	}
+	for _, k := range w.absent {
+		res.resolve(k, false)
+	}
+	return nil
+}
+
+// Apply actions to records which are kept on cascading deletion
+func (r *RedisCache) applyCascadeActions(pipe redis.Pipeliner, method string, w *walkState) {
+	now := time.Now()
+	for _, key := range w.keptKeys {
+		k := w.kept[key]
+		switch k.action.kind {
+		case cascadeActionExpire:
+			debug(r.w, fmt.Sprintf("[%s] shorten TTL of %s to %s\n", method, key, k.action.ttl))
+			shortenTTLScript.Eval(pipe, append([]string{key}, k.chunks...), int64(k.action.ttl/time.Millisecond))
+			if r.prefixIndex {
+				expirePrefix(pipe, key, now.Add(k.action.ttl))
+			}
+		case cascadeActionStale:
+			stale, err := markStale(k.data, now)
+			if err != nil {
+				debug(r.w, fmt.Sprintf("[%s] failed to mark %s as stale, %s\n", method, key, err.Error()))
+				continue
+			}
+			debug(r.w, fmt.Sprintf("[%s] mark %s as stale\n", method, key))
+			markStaleScript.Eval(pipe, []string{key}, k.data, stale)
+		}
+	}
+}
+
+// Remove deleted dependents from reverse dependency index of their parents, and deleted keys from tag index
+func unindexDependents(pipe redis.Pipeliner, w *walkState) {
+	for p, keys := range w.unindex {
+		pipe.SRem(dependentsKey(p), members(keys)...)
+	}
+	for t, keys := range w.untag {
+		pipe.SRem(tagKey(t), members(keys)...)
+	}
+}
+
+func members(keys []string) []interface{} {
+	m := make([]interface{}, len(keys))
+	for i, k := range keys {
+		m[i] = k
+	}
+	return m
 }
 
-func (r *RedisCache) factoryDeleteKeys(method string, keys ...interface{}) []string {
-	deleteKeys := []string{}
+// Delete keys which have any of tags, and their relevant caches.
+// Tagged keys are listed from tag index without scanning keys, and keys which no longer have the tag are skipped.
+// Note that this always walks relevant keys on client side even if atomic delete is enabled.
+func (r *RedisCache) InvalidateTags(tags ...string) error {
+	cmds := make([]*redis.StringSliceCmd, len(tags))
+	_, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, t := range tags {
+			cmds[i] = pipe.SMembers(tagKey(t))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w := newWalkState(r.maxDepth, r.w)
+	frontier := newWalkFrontier()
+	tagged := map[string][]string{}
+	for i, t := range tags {
+		keys, _ := cmds[i].Result()
+		sort.Strings(keys)
+		debug(r.w, fmt.Sprintf("[TAG] %s is tagged to %q\n", t, keys))
+		for _, k := range keys {
+			frontier.addTagged(k, t)
+		}
+		tagged[t] = keys
+	}
+	keys, walkErr := r.walkFrontier(frontier, w)
+	// Skipped keys are also removed because they no longer have the tag
+	for t, k := range tagged {
+		w.untag[t] = append(w.untag[t], k...)
+	}
+	if err := r.deleteKeys("TAG", keys, w, nil); err != nil {
+		return err
+	}
+	return walkErr
+}
 
+func (r *RedisCache) rootKeys(method string, keys ...interface{}) []string {
+	roots := []string{}
 	for _, v := range keys {
 		key, err := getKey(v)
 		if err != nil {
@@ -183,70 +784,432 @@ func (r *RedisCache) factoryDeleteKeys(method string, keys ...interface{}) []str
 			continue
 		}
 		debug(r.w, fmt.Sprintf("[%s] key is: %s\n", method, key))
-
-		keys := r.factoryRelevantKeys(key)
-		debug(r.w, fmt.Sprintf("[%s] factory keys are: %q\n", method, keys))
-
-		deleteKeys = append(deleteKeys, keys...)
+		roots = append(roots, key)
 	}
+	return roots
+}
 
-	return deleteKeys
+func (r *RedisCache) factoryDeleteKeys(method string, w *walkState, keys ...interface{}) ([]string, error) {
+	deleteKeys, err := r.walk(r.rootKeys(method, keys...), w)
+	debug(r.w, fmt.Sprintf("[%s] factory keys are: %q\n", method, deleteKeys))
+	return deleteKeys, err
 }
 
 // Resolve and factory of relevant cahce keys.
-// To resolve relevant cahe keys, we access to redis eatch time.
-// It might be affect to performance, so we recommend to nesting cahe at least less than 4 or 5.
-func (r *RedisCache) factoryRelevantKeys(key string) []string {
-	// When key contains asterisk sign, whe should list as KEYS command to match against keys
-	if strings.Contains(key, "*") {
-		return r.factoryRelevantKeysWithAsterisk(key)
+func (r *RedisCache) factoryRelevantKeys(key string, w *walkState) ([]string, error) {
+	return r.walk([]string{key}, w)
+}
+
+// Resolve keys which should be deleted with roots by breadth-first search.
+// Records and dependents of each level are fetched by one pipeline,
+// so round trips are about the depth of the graph rather than the count of keys.
+func (r *RedisCache) walk(roots []string, w *walkState) ([]string, error) {
+	frontier := newWalkFrontier()
+	for _, k := range roots {
+		frontier.add(k, nil, "", CascadeAction{}).wildcard = strings.Contains(k, "*")
 	}
+	return r.walkFrontier(frontier, w)
+}
 
+// Walk from keys in the frontier level by level
+func (r *RedisCache) walkFrontier(frontier *walkFrontier, w *walkState) ([]string, error) {
 	relevantKeys := []string{}
-	b, err := r.conn.Get(key).Bytes()
-	if err != nil {
-		debug(r.w, fmt.Sprintf("failed to get record for delete. Key is %v, %s\n", key, err.Error()))
-		return relevantKeys
+	var walkErr error
+	setErr := func(err error) {
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
+	}
+
+	for len(frontier.nodes) > 0 {
+		nodes := []*walkNode{}
+		expanded, expandErr := r.expandPatterns(frontier.nodes, w)
+		setErr(expandErr)
+		for _, n := range expanded {
+			if !w.isVisited(n.key) {
+				nodes = append(nodes, n)
+				continue
+			}
+			for _, a := range n.actions {
+				w.strengthen(n.key, a)
+			}
+		}
+		if len(nodes) == 0 {
+			break
+		}
+
+		gets := make([]*redis.StringCmd, len(nodes))
+		members := make([]*redis.StringSliceCmd, len(nodes))
+		// Error of the pipeline is checked for each node, because GET fails for hashes and missing keys as well
+		r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, n := range nodes {
+				gets[i] = pipe.Get(n.key)
+				members[i] = pipe.SMembers(dependentsKey(n.key))
+			}
+			return nil
+		})
+		keys := make([]string, len(nodes))
+		for i, n := range nodes {
+			keys[i] = n.key
+		}
+		hashes := r.fetchHashMeta(keys, gets)
+
+		next := newWalkFrontier()
+		for i, n := range nodes {
+			var rec *record
+			b, err := gets[i].Bytes()
+			if meta, ok := hashes[i]; ok {
+				b, err = meta, nil
+			}
+			missing := err == redis.Nil
+			if missing {
+				err = nil
+			}
+			if err == nil {
+				err = members[i].Err()
+			}
+			if err != nil {
+				// Key which can't be fetched is neither deleted nor treated as missing
+				debug(r.w, fmt.Sprintf("[REL] failed to fetch %s on walking, %s\n", n.key, err.Error()))
+				setErr(w.fail(n.key, err))
+				continue
+			}
+			if missing {
+				b = nil
+			} else if rec, err = r.opts.decodeForWalk(n.key, b); err != nil {
+				debug(r.w, fmt.Sprintf("[REL] %s\n", err.Error()))
+				setErr(w.fail(n.key, err))
+			}
+			if !n.accepts(rec) {
+				debug(r.w, fmt.Sprintf("[REL] %s no longer depends on %q or has tags %q, skipped\n", n.key, n.via, n.tags))
+				continue
+			}
+			if w.isVisited(n.key) {
+				for _, a := range n.actions {
+					w.strengthen(n.key, a)
+				}
+				continue
+			}
+			w.visited[n.key] = struct{}{}
+
+			action := n.action(rec)
+			if _, ok := hashes[i]; ok && action == CascadeStale {
+				// Hash can't be served as stale, so it's deleted instead
+				action = CascadeDelete
+			}
+			found := []string{}
+			if b != nil {
+				found = append(found, n.key)
+			}
+			path := append(append([]string{}, n.path...), n.key)
+			var relations, chunkKeys []string
+			if rec != nil {
+				chunkKeys, err = rec.chunkKeys()
+				setErr(w.fail(n.key, corruptRecordOrNil(n.key, err)))
+				for _, k := range chunkKeys {
+					w.edge(n.key, k, EdgeChunk, "")
+				}
+				found = append(found, chunkKeys...)
+				relations, err = rec.relevantKeys()
+				setErr(w.fail(n.key, corruptRecordOrNil(n.key, err)))
+			}
+			dependents, _ := members[i].Result()
+			if len(dependents) > 0 {
+				sort.Strings(dependents)
+			}
+			if action != CascadeDelete {
+				// Kept record still cascades to its relations, but indexes are kept with it
+				if b != nil {
+					w.keep(n.key, action, b, chunkKeys)
+				}
+			} else {
+				if b == nil {
+					w.absent = append(w.absent, n.key)
+				}
+				if rec != nil {
+					w.unindexDependent(rec, n.key)
+				}
+				if len(dependents) > 0 {
+					// Index is deleted with parent
+					w.edge(n.key, dependentsKey(n.key), EdgeIndex, "")
+					found = append(found, dependentsKey(n.key))
+				}
+				relevantKeys = append(relevantKeys, found...)
+			}
+			debug(r.w, fmt.Sprintf("[REL] %s is relevant to %q and depended by %q\n", n.key, relations, dependents))
+
+			if len(relations)+len(dependents) == 0 {
+				continue
+			}
+			if err := w.checkDepth(path); err != nil {
+				setErr(err)
+				continue
+			}
+			for _, k := range relations {
+				wildcard := rec.isWildcard(k)
+				// Edges to matched keys are recorded on expanding the pattern
+				if !wildcard {
+					w.edge(n.key, k, EdgeRelevant, "")
+				}
+				if w.isVisited(k) {
+					w.strengthen(k, rec.edgeAction(k))
+					w.reportCycle(path, k)
+					continue
+				}
+				next.add(k, path, "", rec.edgeAction(k)).wildcard = wildcard
+			}
+			for _, k := range dependents {
+				w.edge(n.key, k, EdgeDependent, "")
+				if w.isVisited(k) {
+					w.strengthen(k, CascadeAction{})
+					w.reportCycle(path, k)
+					continue
+				}
+				next.add(k, path, n.key, CascadeAction{})
+			}
+		}
+		frontier = next
 	}
+	return relevantKeys, walkErr
+}
 
-	relevantKeys = append(relevantKeys, key)
-	keys, _ := decodeMeta(b)
-	if keys == nil {
-		return relevantKeys
+// Fetch relations of keys which are hashes from the reserved field. gets are results of reading keys as string,
+// key of returned map is index of keys, and value is empty for the hash which has no relations.
+func (r *RedisCache) fetchHashMeta(keys []string, gets []*redis.StringCmd) map[int][]byte {
+	hashes := map[int][]byte{}
+	metas := map[int]*redis.StringCmd{}
+	for i, g := range gets {
+		if isWrongType(g.Err()) {
+			metas[i] = nil
+		}
 	}
-	relevant := bytes.Split(keys, []byte(keyDelimiter))
-	for _, v := range relevant {
-		rKeys := r.factoryRelevantKeys(string(v))
-		relevantKeys = append(relevantKeys, rKeys...)
+	if len(metas) == 0 {
+		return hashes
+	}
+	r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+		for i := range metas {
+			metas[i] = pipe.HGet(keys[i], hashMetaField)
+		}
+		return nil
+	})
+	for i, cmd := range metas {
+		if b, err := cmd.Bytes(); err == nil {
+			hashes[i] = b
+		} else if err == redis.Nil {
+			hashes[i] = []byte{}
+		}
 	}
-	debug(r.w, fmt.Sprintf("[REL] %s is relevant to %q\n", key, relevantKeys))
-	return relevantKeys
+	return hashes
 }
 
-// Dealing asterisk sign
-func (r *RedisCache) factoryRelevantKeysWithAsterisk(key string) []string {
-	relevantKeys := []string{}
+// Replace wildcard nodes with keys which match the pattern.
+// If expansion fails or is stopped by budget, keys which are matched so far are used and the first error is returned.
+// Errors are recorded to w with the pattern as well.
+func (r *RedisCache) expandPatterns(nodes []*walkNode, w *walkState) ([]*walkNode, error) {
+	expanded := make([]*walkNode, 0, len(nodes))
+	var expandErr error
+	setErr := func(err error) {
+		if err != nil && expandErr == nil {
+			expandErr = err
+		}
+	}
+	for _, n := range nodes {
+		if !n.wildcard {
+			expanded = append(expanded, n)
+			continue
+		}
+		s := newWildcardScanner(lastKey(n.path), n.key, r.budget)
+		var err error
+		if r.prefixIndex {
+			err = r.scanPrefixIndex(s)
+		} else {
+			err = r.scanKeyspace(s)
+		}
+		if err != nil {
+			debug(r.w, fmt.Sprintf("failed to scan keys for %s, %s\n", n.key, err.Error()))
+			setErr(w.fail(n.key, err))
+		}
+		debug(r.w, fmt.Sprintf("[REL-ASTERISK] %s is relevant to %q\n", n.key, s.e.Matched))
+		setErr(w.expanded(s.e))
+		for _, k := range s.e.Matched {
+			w.edge(lastKey(n.path), k, EdgeRelevant, n.key)
+			expanded = append(expanded, &walkNode{
+				key:      k,
+				path:     n.path,
+				relevant: true,
+				actions:  n.actions,
+			})
+		}
+	}
+	return expanded, expandErr
+}
+
+// Expand pattern by SCAN command
+func (r *RedisCache) scanKeyspace(s *wildcardScanner) error {
 	cursor := uint64(0)
-	count := int64(1000)
+	for s.next() {
+		count := s.batch(1000)
+		keys, c, err := r.conn.Scan(cursor, s.e.Pattern, int64(count)).Result()
+		if err != nil {
+			return err
+		}
+		s.add(count, keys...)
+		if c == 0 {
+			break
+		}
+		cursor = c
+	}
+	return nil
+}
+
+// Lua script which removes up to ARGV[2] members which are expired at ARGV[1] from the prefix index, returns count of them
+var prunePrefixIndexScript = redis.NewScript(`
+local expired = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+if #expired > 0 then
+	redis.call("ZREM", KEYS[1], unpack(expired))
+	redis.call("ZREM", KEYS[2], unpack(expired))
+end
+return #expired
+`)
+
+// Remove members of expired keys from the prefix index
+func (r *RedisCache) prunePrefixIndex() error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
 	for {
-		keys, c, err := r.conn.Scan(cursor, key, count).Result()
+		n, err := prunePrefixIndexScript.Run(r.conn, []string{prefixIndexKey, prefixExpiryKey}, now, 1000).Int64()
 		if err != nil {
-			debug(r.w, fmt.Sprintf("failed to scan keys for %s, %s\n", key, err.Error()))
-			return relevantKeys
+			return err
+		} else if n < 1000 {
+			return nil
 		}
-		for _, k := range keys {
-			ks := r.factoryRelevantKeys(k)
-			relevantKeys = append(relevantKeys, ks...)
+	}
+}
+
+// Expand pattern by prefix index. Members which start with the literal prefix of pattern are listed by ZRANGEBYLEX
+// after members of expired keys are pruned.
+func (r *RedisCache) scanPrefixIndex(s *wildcardScanner) error {
+	if err := r.prunePrefixIndex(); err != nil {
+		return err
+	}
+	prefix := globPrefix(s.e.Pattern)
+	min := "[" + prefix
+	for s.next() {
+		count := s.batch(1000)
+		members, err := r.conn.ZRangeByLex(prefixIndexKey, redis.ZRangeBy{
+			Min:   min,
+			Max:   "+",
+			Count: int64(count),
+		}).Result()
+		if err != nil {
+			return err
+		}
+		matched := []string{}
+		for _, k := range members {
+			if !strings.HasPrefix(k, prefix) {
+				s.add(len(members), matched...)
+				return nil
+			}
+			if globMatch(s.e.Pattern, k) {
+				matched = append(matched, k)
+			}
+		}
+		s.add(len(members), matched...)
+		if len(members) < count {
+			break
+		}
+		min = "(" + members[len(members)-1]
+	}
+	return nil
+}
+
+// Add keys which are already stored to the prefix index, and remove members of missing keys from the index.
+// Keys which are set before enabling prefix index or set by other clients are indexed by this, so run it after enabling the option.
+// Returns count of keys which are indexed.
+func (r *RedisCache) BuildPrefixIndex() (int, error) {
+	indexed := 0
+	cursor := uint64(0)
+	for {
+		scanned, c, err := r.conn.Scan(cursor, "*", 1000).Result()
+		if err != nil {
+			return indexed, err
+		}
+		keys := make([]string, 0, len(scanned))
+		for _, k := range scanned {
+			if !isIndexKey(k) && !isChunkKey(k) {
+				keys = append(keys, k)
+			}
+		}
+		ttls := make([]*redis.DurationCmd, len(keys))
+		if _, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				ttls[i] = pipe.PTTL(k)
+			}
+			return nil
+		}); err != nil {
+			return indexed, err
+		}
+		if _, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				switch ttl := ttls[i].Val(); {
+				case ttl == -2*time.Millisecond:
+					// Key is deleted while scanning
+					continue
+				case ttl > 0:
+					indexPrefix(pipe, k, ttl)
+				default:
+					indexPrefix(pipe, k, 0)
+				}
+				indexed++
+			}
+			return nil
+		}); err != nil {
+			return indexed, err
 		}
 		if c == 0 {
 			break
 		}
 		cursor = c
 	}
-	debug(r.w, fmt.Sprintf("[REL-ASTERISK] %s is relevant to %q\n", key, relevantKeys))
-	return relevantKeys
+
+	min := "-"
+	for {
+		members, err := r.conn.ZRangeByLex(prefixIndexKey, redis.ZRangeBy{Min: min, Max: "+", Count: 1000}).Result()
+		if err != nil || len(members) == 0 {
+			return indexed, err
+		}
+		exists := make([]*redis.IntCmd, len(members))
+		if _, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, k := range members {
+				exists[i] = pipe.Exists(k)
+			}
+			return nil
+		}); err != nil {
+			return indexed, err
+		}
+		missing := []interface{}{}
+		for i, k := range members {
+			if exists[i].Val() == 0 {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) > 0 {
+			if _, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.ZRem(prefixIndexKey, missing...)
+				pipe.ZRem(prefixExpiryKey, missing...)
+				return nil
+			}); err != nil {
+				return indexed, err
+			}
+		}
+		if len(members) < 1000 {
+			return indexed, nil
+		}
+		min = "(" + members[len(members)-1]
+	}
 }
 
+// Wrap of redis.MGET, value is nil for missing key.
+// If corrupt records are found, value is nil for them and first *CorruptRecordError is returned with other values.
 func (r *RedisCache) MGet(keys ...interface{}) ([][]byte, error) {
 	cacheKeys := make([]string, len(keys))
 	for i, k := range keys {
@@ -261,41 +1224,89 @@ func (r *RedisCache) MGet(keys ...interface{}) ([][]byte, error) {
 		return nil, err
 	}
 	ret := make([][]byte, len(cacheKeys))
+	var corruptErr error
 	for i, v := range result {
 		if v == nil {
 			ret[i] = nil
 			continue
 		}
 		str := v.(string)
-		_, data := decodeMeta([]byte(str))
+		if isStaleRecord([]byte(str)) {
+			ret[i] = nil
+			continue
+		}
+		data, err := r.opts.payload(cacheKeys[i], []byte(str), r.fetchChunks)
+		if err != nil {
+			if !IsCorruptRecord(err) {
+				return nil, err
+			}
+			r.dropCorruptRecord(cacheKeys[i], []byte(str), err)
+			if corruptErr == nil {
+				corruptErr = err
+			}
+		}
 		ret[i] = data
 	}
 
-	return ret, nil
+	return ret, corruptErr
 }
 
+// Wrap of redis.HSET. Value is encoded as RawCodec does, e.g. fmt.Sprint for other types than string and []byte.
+// When key is *Item which has relations, they are stored in the reserved field so that Del of the hash cascades.
 func (r *RedisCache) HSet(key interface{}, field string, value interface{}) error {
 	k, err := getKey(key)
 	if err != nil {
 		return err
 	}
-	if err := r.conn.HSet(k, field, value).Err(); err != nil {
-		fmt.Println(err)
+	if field == hashMetaField {
+		return ErrReservedHashField
+	}
+	b, _ := RawCodec.Marshal(value)
+	if b, err = r.opts.encodeField(k, field, b); err != nil {
 		return err
 	}
-	return nil
+	item, ok := key.(*Item)
+	if !ok || hashMeta(item, r.opts.origin) == nil {
+		if err := r.conn.HSet(k, field, b).Err(); err != nil {
+			fmt.Println(err)
+			return err
+		}
+		return nil
+	}
+
+	debug(r.w, fmt.Sprintf("[HSET] hash key %s is relevant to %q\n", k, item.getRelevaneKeys()))
+	_, err = r.conn.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(k, field, b)
+		pipe.HSet(k, hashMetaField, hashMeta(item, r.opts.origin))
+		indexDependent(pipe, k, item.getDependsKeys(), 0)
+		indexTags(pipe, k, item.tags, 0)
+		if r.prefixIndex {
+			indexPrefix(pipe, k, 0)
+		}
+		return nil
+	})
+	return err
 }
 
+// Wrap of redis.HLEN, the reserved field which holds relations isn't counted
 func (r *RedisCache) HLen(key interface{}) (int64, error) {
 	k, err := getKey(key)
 	if err != nil {
 		return 0, err
 	}
-	size, err := r.conn.HLen(k).Result()
-	if err != nil {
+	var size *redis.IntCmd
+	var meta *redis.BoolCmd
+	if _, err := r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+		size = pipe.HLen(k)
+		meta = pipe.HExists(k, hashMetaField)
+		return nil
+	}); err != nil {
 		return 0, err
 	}
-	return size, nil
+	if meta.Val() {
+		return size.Val() - 1, nil
+	}
+	return size.Val(), nil
 }
 
 func (r *RedisCache) HGet(key interface{}, field string) ([]byte, error) {
@@ -303,11 +1314,177 @@ func (r *RedisCache) HGet(key interface{}, field string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if field == hashMetaField {
+		return nil, ErrReservedHashField
+	}
 	v, err := r.conn.HGet(k, field).Bytes()
 	if err != nil {
 		return nil, err
 	}
-	return v, nil
+	return r.opts.decodeField(k, field, v)
+}
+
+// Size of GETRANGE window on streaming
+const redisRangeSize = 64 * 1024
+
+// Reader which reads string value by GETRANGE window.
+// err holds the error from redis so that caller can distinguish it from broken record.
+type redisRangeReader struct {
+	conn   *redis.Client
+	key    string
+	offset int64
+	err    error
+}
+
+func (r *redisRangeReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	size := int64(len(p))
+	if size > redisRangeSize {
+		size = redisRangeSize
+	}
+	b, err := r.conn.GetRange(r.key, r.offset, r.offset+size-1).Bytes()
+	if err != nil {
+		r.err = err
+		return 0, err
+	}
+	if len(b) == 0 {
+		if r.offset == 0 {
+			// GETRANGE returns empty string for missing key, check existence to report redis.Nil as GET does
+			if n, err := r.conn.Exists(r.key).Result(); err != nil {
+				r.err = err
+				return 0, err
+			} else if n == 0 {
+				r.err = redis.Nil
+				return 0, redis.Nil
+			}
+		}
+		return 0, io.EOF
+	}
+	r.offset += int64(len(b))
+	return copy(p, b), nil
+}
+
+// Size of GETRANGE window to read record header on exporting graph. Longer headers are read by following windows
+const graphHeaderSize = 4 * 1024
+
+// Export relevance graph of all records in the format.
+// Keys are scanned by SCAN command, so keys which are modified while scanning might be inconsistent.
+// Only record headers are read by GETRANGE, and sizes are taken by STRLEN, so record data isn't loaded.
+// Relations of hashes are read from the reserved field, and size of hash is 0.
+// Relevant keys with wildcard are expanded within wildcard budget against scanned keys.
+func (r *RedisCache) ExportGraph(w io.Writer, format GraphFormat) error {
+	records := []graphRecord{}
+	cursor := uint64(0)
+	for {
+		scanned, c, err := r.conn.Scan(cursor, "*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(scanned))
+		for _, k := range scanned {
+			if !isIndexKey(k) {
+				keys = append(keys, k)
+			}
+		}
+		heads := make([]*redis.StringCmd, len(keys))
+		sizes := make([]*redis.IntCmd, len(keys))
+		ttls := make([]*redis.DurationCmd, len(keys))
+		// Error of the pipeline is ignored because GETRANGE and STRLEN fail for other types than string like hash
+		r.conn.Pipelined(func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				heads[i] = pipe.GetRange(k, 0, graphHeaderSize-1)
+				sizes[i] = pipe.StrLen(k)
+				ttls[i] = pipe.PTTL(k)
+			}
+			return nil
+		})
+		hashes := r.fetchHashMeta(keys, heads)
+		for i, k := range keys {
+			ttl, err := ttls[i].Result()
+			if err != nil {
+				return err
+			} else if ttl == -2*time.Millisecond {
+				// Key is deleted while scanning
+				continue
+			}
+			rec := graphRecord{
+				key: k,
+				ttl: -1,
+			}
+			if ttl >= 0 {
+				rec.ttl = int64(ttl / time.Millisecond)
+			}
+			if meta, ok := hashes[i]; ok {
+				// Relations of hash are read from the reserved field
+				var err error
+				rec.header, err = decodeRecord(meta)
+				rec.corrupt = err != nil
+			} else if head, err := heads[i].Bytes(); err == nil {
+				rec.size = int(sizes[i].Val())
+				// Header which is longer than the window is read by following GETRANGE
+				src := &redisRangeReader{conn: r.conn, key: k, offset: int64(len(head))}
+				rec.header, err = decodeRecordHeader(bufio.NewReader(io.MultiReader(bytes.NewReader(head), src)))
+				if src.err != nil && src.err != redis.Nil {
+					return src.err
+				}
+				rec.corrupt = err != nil
+			} else if !isWrongType(err) {
+				return err
+			}
+			records = append(records, rec)
+		}
+		if c == 0 {
+			break
+		}
+		cursor = c
+	}
+	return writeGraph(w, format, buildGraph(records, r.budget))
+}
+
+// Scan keys for migration
+func (r *RedisCache) scanKeys(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	return r.conn.Scan(cursor, match, count).Result()
+}
+
+// Rewrite record with keeping TTL. The record is watched and rewriting is retried if it's modified by others
+func (r *RedisCache) rewriteRecord(key string, fn func(dat []byte) ([]byte, error)) error {
+	rewrite := func(tx *redis.Tx) error {
+		dat, err := tx.Get(key).Bytes()
+		if err == redis.Nil {
+			return errMigrationUnmatched
+		} else if err != nil {
+			// Other types than string like hash never have records
+			if isWrongType(err) {
+				return errMigrationUnmatched
+			}
+			return err
+		}
+		ttl, err := tx.PTTL(key).Result()
+		if err != nil {
+			return err
+		} else if ttl < 0 {
+			ttl = 0
+		}
+		converted, err := fn(dat)
+		if err != nil || converted == nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, converted, ttl)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.conn.Watch(rewrite, key); err != redis.TxFailedErr {
+			return err
+		}
+		debug(r.w, fmt.Sprintf("[MIGRATE] %s is modified while rewriting, retry\n", key))
+	}
+	return redis.TxFailedErr
 }
 
 var _ Cache = (*RedisCache)(nil)
+var _ recordStore = (*RedisCache)(nil)
@@ -0,0 +1,115 @@
+package relevantcache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Shadow record lives longer than the record by this period, so that it can be read on expired event
+const shadowGracePeriod = time.Minute
+
+// Lua script which claims cascading deletion of expired key by setting the claim key KEYS[1] for ARGV[1] milliseconds.
+// Returns the shadow record KEYS[2], empty string if it doesn't exist, or nil if the key is already claimed by others.
+var claimExpiredScript = redis.NewScript(`
+if not redis.call("SET", KEYS[1], "1", "NX", "PX", ARGV[1]) then
+	return false
+end
+return redis.call("GET", KEYS[2]) or ""
+`)
+
+// Store record header as shadow record when the record has TTL and relevant keys, otherwise remove old shadow record.
+// Claim of the previous expiration is removed so that the key is cascaded again when it's expired again.
+func setShadow(pipe redis.Pipeliner, key string, value interface{}, expire time.Duration) {
+	pipe.Del(expiredClaimKey(key))
+	if dat, ok := value.([]byte); ok && expire > 0 {
+		if shadow := shadowRecord(dat); shadow != nil {
+			pipe.Set(shadowKey(key), shadow, expire+shadowGracePeriod)
+			return
+		}
+	}
+	pipe.Del(shadowKey(key))
+}
+
+// Subscribe expired events of keyspace notifications on db, and cascade deletion in background.
+// notify-keyspace-events is never changed because the server might be shared with others.
+// ErrKeyspaceNotificationsDisabled is returned if it doesn't include expired events, but it's not checked
+// when CONFIG command isn't allowed like managed redis.
+func (r *RedisCache) subscribeExpired(db int) error {
+	if config, err := r.conn.ConfigGet("notify-keyspace-events").Result(); err != nil {
+		debug(r.w, fmt.Sprintf("[EXPIRE] failed to check keyspace notifications, %s\n", err.Error()))
+	} else if len(config) == 2 {
+		if !expiredEventsEnabled(fmt.Sprint(config[1])) {
+			return ErrKeyspaceNotificationsDisabled
+		}
+	}
+
+	pubsub := r.conn.Subscribe(fmt.Sprintf("__keyevent@%d__:expired", db))
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return err
+	}
+	r.pubsub = pubsub
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for msg := range pubsub.Channel() {
+			// Chunks and indexes expire with records, so they don't cascade by themselves
+			if isIndexKey(msg.Payload) || isChunkKey(msg.Payload) {
+				continue
+			}
+			if err := r.cascadeExpired(msg.Payload); err != nil {
+				debug(r.w, fmt.Sprintf("[EXPIRE] failed to cascade expired key %s, %s\n", msg.Payload, err.Error()))
+			}
+		}
+	}()
+	return nil
+}
+
+// Report whether notify-keyspace-events flags publish expired events to keyevent channel.
+// E enables keyevent channel, and expired events are enabled by x or A which is reported instead of all classes, e.g. AKE.
+func expiredEventsEnabled(flags string) bool {
+	return strings.Contains(flags, "E") && (strings.Contains(flags, "x") || strings.Contains(flags, "A"))
+}
+
+// Delete relevant caches and dependents of expired key as Del does.
+// Every subscribing process receives the event, so only the process which claims the key cascades deletion.
+// Relevant keys are resolved from shadow record because the record is already expired.
+func (r *RedisCache) cascadeExpired(key string) error {
+	// Key is set again after expired, so relations of the new record are kept
+	if n, err := r.conn.Exists(key).Result(); err != nil {
+		return err
+	} else if n > 0 {
+		debug(r.w, fmt.Sprintf("[EXPIRE] %s is set again after expired. skipped\n", key))
+		return nil
+	}
+	claim := []string{expiredClaimKey(key), shadowKey(key)}
+	shadow, err := claimExpiredScript.Run(r.conn, claim, int64(shadowGracePeriod/time.Millisecond)).String()
+	if err == redis.Nil {
+		debug(r.w, fmt.Sprintf("[EXPIRE] %s is claimed by other process. skipped\n", key))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	debug(r.w, fmt.Sprintf("[EXPIRE] key is: %s\n", key))
+
+	w := newWalkState(r.maxDepth, r.w)
+	frontier := newWalkFrontier()
+	frontier.add(key, nil, "", CascadeAction{})
+	if shadow != "" {
+		if rec, err := decodeRecord([]byte(shadow)); err == nil && rec != nil {
+			relations, _ := rec.relevantKeys()
+			for _, k := range relations {
+				frontier.add(k, []string{key}, "", rec.edgeAction(k)).wildcard = rec.isWildcard(k)
+			}
+		}
+	}
+	keys, walkErr := r.walkFrontier(frontier, w)
+	debug(r.w, fmt.Sprintf("[EXPIRE] factory keys are: %q\n", keys))
+	if err := r.deleteKeys("EXPIRE", keys, w, nil); err != nil {
+		return err
+	}
+	return walkErr
+}
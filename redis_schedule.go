@@ -0,0 +1,129 @@
+package relevantcache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Lua script which claims keys which are due at ARGV[1] from the schedule KEYS[1], up to ARGV[2] keys.
+// Keys whose lease in KEYS[2] is expired at ARGV[1] are claimed first, and claimed keys are leased until ARGV[3].
+// Keys are moved in the script, so each key is deleted by only one worker at once.
+var claimScheduleScript = redis.NewScript(`
+local limit = tonumber(ARGV[2])
+local keys = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", ARGV[1], "LIMIT", 0, limit)
+if #keys < limit then
+	local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, limit - #keys)
+	if #due > 0 then
+		redis.call("ZREM", KEYS[1], unpack(due))
+	end
+	for _, k in ipairs(due) do
+		table.insert(keys, k)
+	end
+end
+for _, k in ipairs(keys) do
+	redis.call("ZADD", KEYS[2], ARGV[3], k)
+end
+return keys
+`)
+
+// Schedule items to be deleted with relevant caches at t by the worker.
+// Scheduling the same key again replaces the time. Items are deleted only by clients which run the worker,
+// see WithScheduleWorker.
+func (r *RedisCache) DelAt(t time.Time, items ...interface{}) error {
+	roots := r.rootKeys("SCHEDULE", items...)
+	if len(roots) == 0 {
+		return nil
+	}
+	score := float64(t.UnixNano() / int64(time.Millisecond))
+	z := make([]redis.Z, len(roots))
+	for i, k := range roots {
+		z[i] = redis.Z{Score: score, Member: k}
+	}
+	debug(r.w, fmt.Sprintf("[SCHEDULE] delete %q at %s\n", roots, t.Format(time.RFC3339Nano)))
+	return r.conn.ZAdd(scheduleKey, z...).Err()
+}
+
+// Schedule items to be deleted with relevant caches after d
+func (r *RedisCache) DelAfter(d time.Duration, items ...interface{}) error {
+	return r.DelAt(time.Now().Add(d), items...)
+}
+
+// Delete scheduled keys which are due every interval until Close
+func (r *RedisCache) scheduleWorker(interval time.Duration) {
+	defer r.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			if err := r.runSchedule(time.Now()); err != nil {
+				debug(r.w, fmt.Sprintf("[SCHEDULE] failed to delete scheduled keys, %s\n", err.Error()))
+			}
+		}
+	}
+}
+
+// Claim keys which are due at now and delete them as Del does.
+// Leases of keys are released when they are deleted, otherwise keys are deleted again after the lease expires.
+func (r *RedisCache) runSchedule(now time.Time) error {
+	max := now.UnixNano() / int64(time.Millisecond)
+	lease := now.Add(scheduleLeaseTimeout).UnixNano() / int64(time.Millisecond)
+	for {
+		result, err := claimScheduleScript.Run(r.conn, []string{scheduleKey, scheduleLeaseKey}, max, scheduleBatchSize, lease).Result()
+		if err != nil {
+			return err
+		}
+		keys := replyStrings(result)
+		if len(keys) == 0 {
+			return nil
+		}
+		debug(r.w, fmt.Sprintf("[SCHEDULE] delete scheduled keys %q\n", keys))
+		items := make([]interface{}, len(keys))
+		for i, k := range keys {
+			items[i] = k
+		}
+		res, err := r.DelWithResult(items...)
+		done := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			if err == nil || scheduleDone(res, k) {
+				done = append(done, k)
+			}
+		}
+		if err != nil {
+			debug(r.w, fmt.Sprintf("[SCHEDULE] %s, %d keys will be retried\n", err.Error(), len(keys)-len(done)))
+		}
+		if len(done) > 0 {
+			if err := r.conn.ZRem(scheduleLeaseKey, done...).Err(); err != nil {
+				return err
+			}
+		}
+		if len(keys) < scheduleBatchSize {
+			return nil
+		}
+	}
+}
+
+// Report whether scheduled key is deleted even if deletion returns error.
+// Key is done when it's resolved, or it's a pattern which is expanded without error except for budget.
+func scheduleDone(res *InvalidationResult, key string) bool {
+	if res == nil {
+		return false
+	}
+	if _, ok := res.resolved[key]; ok {
+		return true
+	}
+	if !strings.Contains(key, "*") {
+		return false
+	}
+	err, ok := res.Errors[key]
+	if !ok {
+		return true
+	}
+	_, ok = err.(*WildcardBudgetError)
+	return ok
+}
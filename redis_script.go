@@ -0,0 +1,798 @@
+package relevantcache
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Lua script which walks relevant keys and dependents, and deletes them atomically on the server.
+// Headers of both legacy and version 2 records are parsed by the script, but checksum is not verified
+// and corrupt records are deleted without following their relations.
+// Cascade actions are applied as the client-side walk does, so reached records may be kept with shorter TTL or as stale.
+// Deleted keys are removed from reverse dependency index of their parents and from tag index as well.
+// Wildcard keys are expanded by SCAN or the prefix index within budget, but timeout of budget is not applied.
+// The script doesn't expand them without max scanned keys so as not to block the server, and fails before writing anything.
+// Relations of hashes are read from the reserved field, and hashes are deleted instead of being marked as stale.
+//
+// KEYS: root keys
+// ARGV[1]: DEL or UNLINK
+// ARGV[2]: max relevance depth, 0 means unlimited
+// ARGV[3]: 1 if shadow records should be deleted
+// ARGV[4]: stale section which is set to records marked as stale
+// ARGV[5]: 1 if wildcard keys are expanded by the prefix index
+// ARGV[6]: max scanned keys of wildcard budget, 0 means unlimited
+// ARGV[7]: max matched keys of wildcard budget, 0 means unlimited
+// ARGV[8]: current time in unix milliseconds to prune expired members of the prefix index
+//
+// Returns removed keys, path to the key whose relations are not followed over max depth or empty list,
+// expansions of wildcard keys as {from, pattern, scanned, limit or empty string, matched keys},
+// and keys which are resolved but already missing.
+var cascadeDeleteScript = redis.NewScript(fmt.Sprintf(`
+local DEPENDENTS_PREFIX = %q
+local TAG_PREFIX = %q
+local SHADOW_PREFIX = %q
+local FLAG_CHUNKS = %d
+local FLAG_KEY_LIST = %d
+local FLAG_META = %d
+local FLAG_DEPENDS = %d
+local FLAG_CASCADE = %d
+local FLAG_STALE = %d
+local FLAG_WILDCARD = %d
+local PREFIX_INDEX = %q
+local PREFIX_EXPIRY = %q
+local HASH_META = %q
+local ACTION_DELETE = %d
+local ACTION_EXPIRE = %d
+local ACTION_STALE = %d
+local UNBOUNDED_WILDCARD = %q
+local DELETE = {ACTION_DELETE, 0}
+
+local function uvarint(s, p)
+	local v, mul = 0, 1
+	while true do
+		local b = string.byte(s, p)
+		if not b then
+			return nil, p
+		end
+		v = v + (b %% 128) * mul
+		p = p + 1
+		if b < 128 then
+			return v, p
+		end
+		mul = mul * 128
+	end
+end
+
+local function put_uvarint(v)
+	local b = {}
+	while v >= 128 do
+		table.insert(b, string.char(v %% 128 + 128))
+		v = math.floor(v / 128)
+	end
+	table.insert(b, string.char(v))
+	return table.concat(b)
+end
+
+local function has_flag(flags, bit)
+	return math.floor(flags / 2 ^ bit) %% 2 == 1
+end
+
+local function split(s, sep)
+	local keys = {}
+	if s == "" then
+		return keys
+	end
+	local p = 1
+	while true do
+		local i = string.find(s, sep, p, true)
+		if not i then
+			table.insert(keys, string.sub(s, p))
+			return keys
+		end
+		table.insert(keys, string.sub(s, p, i - 1))
+		p = i + #sep
+	end
+end
+
+local function key_list(s)
+	local keys = {}
+	local count, p = uvarint(s, 1)
+	for i = 1, (count or 0) do
+		local n
+		n, p = uvarint(s, p)
+		if not n then
+			break
+		end
+		table.insert(keys, string.sub(s, p, p + n - 1))
+		p = p + n
+	end
+	return keys
+end
+
+local function is_legacy(dat)
+	return #dat > 3 and string.sub(dat, 1, 2) == "$\0"
+end
+
+-- Returns keys and data of legacy record
+local function legacy(dat)
+	local size = string.byte(dat, 3) * 256 + string.byte(dat, 4)
+	return string.sub(dat, 5, 4 + size), string.sub(dat, 5 + size)
+end
+
+-- Returns flags, keys, sections by bit and data of version 2 record, or nil if it's not a version 2 record
+local function sections(dat)
+	if string.sub(dat, 1, 3) ~= "$rc" or string.byte(dat, 4) ~= 2 then
+		return nil
+	end
+	local flags, p = uvarint(dat, 5)
+	local size
+	size, p = uvarint(dat, p)
+	if not flags or not size then
+		return nil
+	end
+	local keys = string.sub(dat, p, p + size - 1)
+	p = p + size
+	local secs = {}
+	for bit = 0, 52 do
+		if has_flag(flags, bit) then
+			size, p = uvarint(dat, p)
+			if not size then
+				return nil
+			end
+			secs[bit] = string.sub(dat, p, p + size - 1)
+			p = p + size
+		end
+	end
+	return flags, keys, secs, string.sub(dat, p)
+end
+
+-- Returns tags in meta section as [created at][version][origin length][origin][tags as key list].
+-- Signed varints are skipped as unsigned ones because only their length matters
+local function meta_tags(s)
+	local _, p = uvarint(s, 1)
+	_, p = uvarint(s, p)
+	local n
+	n, p = uvarint(s, p)
+	if not n then
+		return {}
+	end
+	return key_list(string.sub(s, p + n))
+end
+
+-- Returns action {kind, ttl in milliseconds} at p, or nil if it's unset or broken
+local function action(s, p)
+	local kind = string.byte(s, p)
+	local ttl
+	ttl, p = uvarint(s, p + 1)
+	if not kind or not ttl then
+		return nil, p
+	end
+	return {kind, ttl}, p
+end
+
+-- Returns action of the record and actions of relevant keys. Broken section is treated as no actions
+local function cascade(s)
+	local self, p = action(s, 1)
+	local count
+	count, p = uvarint(s, p)
+	if not self or not count then
+		return false, {}
+	end
+	local edges = {}
+	for i = 1, count do
+		local n, a
+		n, p = uvarint(s, p)
+		if not n then
+			return false, {}
+		end
+		local k = string.sub(s, p, p + n - 1)
+		a, p = action(s, p + n)
+		if not a then
+			return false, {}
+		end
+		if a[1] ~= 0 then
+			edges[k] = a
+		end
+	end
+	if self[1] == 0 then
+		self = false
+	end
+	return self, edges
+end
+
+-- Returns relevant keys, chunk keys, depends keys, action of the record, actions of relevant keys,
+-- set of wildcard keys or false if wildcard keys are detected by asterisk, and tags
+local function parse(dat)
+	if is_legacy(dat) then
+		return split(legacy(dat), "|"), {}, {}, false, {}, false, {}
+	end
+	local flags, keys, secs = sections(dat)
+	if not flags then
+		return {}, {}, {}, false, {}, false, {}
+	end
+	local relevant
+	if has_flag(flags, FLAG_KEY_LIST) then
+		relevant = key_list(keys)
+	else
+		relevant = split(keys, "|")
+	end
+	local self, edges = false, {}
+	if secs[FLAG_CASCADE] then
+		self, edges = cascade(secs[FLAG_CASCADE])
+	end
+	local wildcard = false
+	if secs[FLAG_WILDCARD] then
+		wildcard = {}
+		for _, k in ipairs(key_list(secs[FLAG_WILDCARD])) do
+			wildcard[k] = true
+		end
+	end
+	local tags = {}
+	if secs[FLAG_META] then
+		tags = meta_tags(secs[FLAG_META])
+	end
+	return relevant, key_list(secs[FLAG_CHUNKS] or ""), key_list(secs[FLAG_DEPENDS] or ""), self, edges, wildcard, tags
+end
+
+local function is_wildcard(wildcard, key)
+	if wildcard then
+		return wildcard[key] == true
+	end
+	return string.find(key, "*", 1, true) ~= nil
+end
+
+-- Match c against the class which starts with '[' at p[i]. Returns index of the last byte of the class
+local function match_class(p, i, c)
+	local n = #p
+	i = i + 1
+	local negate = string.sub(p, i, i) == "^"
+	if negate then
+		i = i + 1
+	end
+	local match = false
+	while true do
+		local ch = string.sub(p, i, i)
+		if i > n then
+			i = i - 1
+			break
+		elseif ch == "\\" and n - i >= 1 then
+			i = i + 1
+			if string.byte(p, i) == c then
+				match = true
+			end
+		elseif ch == "]" then
+			break
+		elseif n - i >= 2 and string.sub(p, i + 1, i + 1) == "-" then
+			local a, b = string.byte(p, i), string.byte(p, i + 2)
+			if a > b then
+				a, b = b, a
+			end
+			if c >= a and c <= b then
+				match = true
+			end
+			i = i + 2
+		elseif string.byte(p, i) == c then
+			match = true
+		end
+		i = i + 1
+	end
+	return i, match ~= negate
+end
+
+-- Same glob semantics as KEYS command, p and s are matched from index pi and si
+local function glob(p, pi, s, si)
+	local pn, sn = #p, #s
+	while pi <= pn and si <= sn do
+		local ch = string.sub(p, pi, pi)
+		if ch == "*" then
+			while pi < pn and string.sub(p, pi + 1, pi + 1) == "*" do
+				pi = pi + 1
+			end
+			if pi == pn then
+				return true
+			end
+			for j = si, sn do
+				if glob(p, pi + 1, s, j) then
+					return true
+				end
+			end
+			return false
+		elseif ch == "?" then
+			si = si + 1
+		elseif ch == "[" then
+			local ok
+			pi, ok = match_class(p, pi, string.byte(s, si))
+			if not ok then
+				return false
+			end
+			si = si + 1
+		else
+			if ch == "\\" and pn - pi >= 1 then
+				pi = pi + 1
+			end
+			if string.byte(p, pi) ~= string.byte(s, si) then
+				return false
+			end
+			si = si + 1
+		end
+		pi = pi + 1
+		if si > sn then
+			while pi <= pn and string.sub(p, pi, pi) == "*" do
+				pi = pi + 1
+			end
+		end
+	end
+	return pi > pn and si > sn
+end
+
+-- Literal prefix of pattern, which every matched key starts with
+local function literal_prefix(p)
+	local b = {}
+	local i = 1
+	while i <= #p do
+		local ch = string.sub(p, i, i)
+		if ch == "*" or ch == "?" or ch == "[" then
+			break
+		end
+		if ch == "\\" and i < #p then
+			i = i + 1
+			ch = string.sub(p, i, i)
+		end
+		table.insert(b, ch)
+		i = i + 1
+	end
+	return table.concat(b)
+end
+
+local max_scanned = tonumber(ARGV[6])
+local max_matches = tonumber(ARGV[7])
+
+-- Returns keys which match pattern within budget, limit which stops expansion or false, and count of scanned keys
+local function expand(pattern)
+	local matched = {}
+	local scanned = 0
+	local function batch()
+		if max_scanned > 0 and max_scanned - scanned < 1000 then
+			return max_scanned - scanned
+		end
+		return 1000
+	end
+	local function add(k)
+		if max_matches > 0 and #matched >= max_matches then
+			return false
+		end
+		table.insert(matched, k)
+		return true
+	end
+	local function limit()
+		if max_scanned > 0 and scanned >= max_scanned then
+			return "max_scanned"
+		end
+		return false
+	end
+
+	if ARGV[5] == "1" then
+		local expired = redis.call("ZRANGEBYSCORE", PREFIX_EXPIRY, "-inf", ARGV[8], "LIMIT", 0, batch())
+		if #expired > 0 then
+			redis.call("ZREM", PREFIX_INDEX, unpack(expired))
+			redis.call("ZREM", PREFIX_EXPIRY, unpack(expired))
+		end
+		local prefix = literal_prefix(pattern)
+		local min = "[" .. prefix
+		while not limit() do
+			local count = batch()
+			local members = redis.call("ZRANGEBYLEX", PREFIX_INDEX, min, "+", "LIMIT", 0, count)
+			scanned = scanned + #members
+			for _, k in ipairs(members) do
+				if string.sub(k, 1, #prefix) ~= prefix then
+					return matched, false, scanned
+				end
+				if glob(pattern, 1, k, 1) and not add(k) then
+					return matched, "max_matches", scanned
+				end
+			end
+			if #members < count then
+				return matched, false, scanned
+			end
+			min = "(" .. members[#members]
+		end
+	else
+		local cursor = "0"
+		while not limit() do
+			local count = batch()
+			local reply = redis.call("SCAN", cursor, "MATCH", pattern, "COUNT", count)
+			scanned = scanned + count
+			for _, k in ipairs(reply[2]) do
+				if not add(k) then
+					return matched, "max_matches", scanned
+				end
+			end
+			cursor = reply[1]
+			if cursor == "0" then
+				return matched, false, scanned
+			end
+		end
+	end
+	return matched, limit(), scanned
+end
+
+-- Each edge uses its own action, or action of the record if edge doesn't specify it
+local function resolve(edge, self)
+	return edge or self or DELETE
+end
+
+-- Delete is the strongest, and shorter expiration is stronger
+local function stronger(a, b)
+	if a[1] ~= b[1] then
+		return a[1] < b[1]
+	end
+	return a[1] == ACTION_EXPIRE and a[2] < b[2]
+end
+
+-- Encode the record with stale section, data without header is wrapped as it is. Returns nil for unknown records
+local function mark_stale(dat)
+	local flags, keys, secs, data
+	if is_legacy(dat) then
+		keys, data = legacy(dat)
+		flags, secs = 0, {}
+	elseif string.sub(dat, 1, 3) == "$rc" then
+		flags, keys, secs, data = sections(dat)
+		if not flags then
+			return nil
+		end
+	else
+		flags, keys, secs, data = 0, "", {}, dat
+	end
+	if not has_flag(flags, FLAG_STALE) then
+		flags = flags + 2 ^ FLAG_STALE
+	end
+	secs[FLAG_STALE] = ARGV[4]
+	local b = {"$rc", string.char(2), put_uvarint(flags), put_uvarint(#keys), keys}
+	for bit = 0, 52 do
+		if has_flag(flags, bit) then
+			table.insert(b, put_uvarint(#secs[bit]))
+			table.insert(b, secs[bit])
+		end
+	end
+	table.insert(b, data)
+	return table.concat(b)
+end
+
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+
+local max_depth = tonumber(ARGV[2])
+local visited = {}
+local deleted = {}
+local unindex = {}
+local exceeded = {}
+local expansions = {}
+-- Keys which are resolved but have no record
+local missing = {}
+-- Records which are reached but kept with other actions than delete
+local kept = {}
+local kept_keys = {}
+
+-- Queue of {key, depth, parent which the key must depend on, path to the key, action of the edge, whether key is wildcard}
+local queue = {}
+for _, k in ipairs(KEYS) do
+	table.insert(queue, {k, 1, false, {}, false, is_wildcard(false, k)})
+end
+local head = 1
+while head <= #queue do
+	local key, depth, via, from, edge = queue[head][1], queue[head][2], queue[head][3], queue[head][4], queue[head][5]
+	local wildcard = queue[head][6]
+	head = head + 1
+	if wildcard and max_scanned == 0 then
+		return redis.error_reply(UNBOUNDED_WILDCARD .. " " .. key)
+	elseif wildcard then
+		local matched, limit, scanned = expand(key)
+		table.insert(expansions, {from[#from] or "", key, scanned, limit or "", matched})
+		for _, k in ipairs(matched) do
+			table.insert(queue, {k, depth, false, from, edge, false})
+		end
+	elseif visited[key] then
+		-- Reached again by another edge, stronger action wins
+		local k = kept[key]
+		if k then
+			local a = resolve(edge, k.self)
+			if stronger(a, k.action) then
+				k.action = a
+			end
+		end
+	else
+		local ok, dat = pcall(redis.call, "GET", key)
+		local hash = false
+		if not ok then
+			dat = false
+			if redis.call("TYPE", key)["ok"] == "hash" then
+				hash = true
+				dat = redis.call("HGET", key, HASH_META) or ""
+			end
+		end
+		local relevant, chunks, depends, self, edges, wildcards, tags = {}, {}, {}, false, {}, false, {}
+		if dat then
+			relevant, chunks, depends, self, edges, wildcards, tags = parse(dat)
+		end
+		local accepted = not via
+		for _, p in ipairs(depends) do
+			if p == via then
+				accepted = true
+			end
+		end
+		if accepted then
+			visited[key] = true
+			local act = DELETE
+			if #from > 0 then
+				act = resolve(edge, self)
+			end
+			if hash and act[1] == ACTION_STALE then
+				act = DELETE
+			end
+			local dependents = redis.call("SMEMBERS", DEPENDENTS_PREFIX .. key)
+			if act[1] ~= ACTION_DELETE then
+				-- Kept record still cascades to its relations, but indexes are kept with it
+				if dat then
+					kept[key] = {action = act, self = self, dat = dat, chunks = chunks, depends = depends, tags = tags}
+					table.insert(kept_keys, key)
+				end
+			else
+				if dat then
+					table.insert(deleted, key)
+				else
+					table.insert(missing, key)
+				end
+				for _, k in ipairs(chunks) do
+					table.insert(deleted, k)
+				end
+				for _, p in ipairs(depends) do
+					table.insert(unindex, {DEPENDENTS_PREFIX .. p, key})
+				end
+				for _, t in ipairs(tags) do
+					table.insert(unindex, {TAG_PREFIX .. t, key})
+				end
+				if #dependents > 0 then
+					table.insert(deleted, DEPENDENTS_PREFIX .. key)
+				end
+			end
+			if #relevant + #dependents > 0 then
+				local path = {unpack(from)}
+				table.insert(path, key)
+				if max_depth > 0 and depth > max_depth then
+					if #exceeded == 0 then
+						exceeded = path
+					end
+				else
+					for _, k in ipairs(relevant) do
+						table.insert(queue, {k, depth + 1, false, path, edges[k] or false, is_wildcard(wildcards, k)})
+					end
+					for _, k in ipairs(dependents) do
+						table.insert(queue, {k, depth + 1, key, path, false, false})
+					end
+				end
+			end
+		end
+	end
+end
+
+for _, key in ipairs(kept_keys) do
+	local k = kept[key]
+	if k.action[1] == ACTION_DELETE then
+		table.insert(deleted, key)
+		for _, c in ipairs(k.chunks) do
+			table.insert(deleted, c)
+		end
+		if redis.call("EXISTS", DEPENDENTS_PREFIX .. key) == 1 then
+			table.insert(deleted, DEPENDENTS_PREFIX .. key)
+		end
+		for _, p in ipairs(k.depends) do
+			table.insert(unindex, {DEPENDENTS_PREFIX .. p, key})
+		end
+		for _, t in ipairs(k.tags) do
+			table.insert(unindex, {TAG_PREFIX .. t, key})
+		end
+	elseif k.action[1] == ACTION_EXPIRE then
+		local targets = {key, unpack(k.chunks)}
+		for _, t in ipairs(targets) do
+			local ttl = redis.call("PTTL", t)
+			if ttl == -1 or ttl > k.action[2] then
+				redis.call("PEXPIRE", t, k.action[2])
+			end
+		end
+		if ARGV[5] == "1" then
+			redis.call("ZADD", PREFIX_EXPIRY, tonumber(ARGV[8]) + k.action[2], key)
+		end
+	else
+		local dat = mark_stale(k.dat)
+		if dat then
+			local ttl = redis.call("PTTL", key)
+			if ttl > 0 then
+				redis.call("SET", key, dat, "PX", ttl)
+			else
+				redis.call("SET", key, dat)
+			end
+		end
+	end
+end
+
+-- Keys are deleted one by one to report whether each key is removed
+local removed = {}
+local seen = {}
+for _, k in ipairs(deleted) do
+	if not seen[k] then
+		seen[k] = true
+		if redis.call(ARGV[1], k) == 1 then
+			table.insert(removed, k)
+		else
+			table.insert(missing, k)
+		end
+	end
+end
+for _, u in ipairs(unindex) do
+	redis.call("SREM", u[1], u[2])
+end
+if ARGV[3] == "1" then
+	for k in pairs(visited) do
+		if not kept[k] or kept[k].action[1] == ACTION_DELETE then
+			redis.call("DEL", SHADOW_PREFIX .. k)
+		end
+	end
+end
+if ARGV[5] == "1" then
+	for k in pairs(visited) do
+		if not kept[k] or kept[k].action[1] == ACTION_DELETE then
+			redis.call("ZREM", PREFIX_INDEX, k)
+			redis.call("ZREM", PREFIX_EXPIRY, k)
+		end
+	end
+end
+return {removed, exceeded, expansions, missing}
+`,
+	dependentsKeyPrefix,
+	tagKeyPrefix,
+	shadowKeyPrefix,
+	bits.TrailingZeros64(flagChunks),
+	bits.TrailingZeros64(flagKeyList),
+	bits.TrailingZeros64(flagMeta),
+	bits.TrailingZeros64(flagDepends),
+	bits.TrailingZeros64(flagCascade),
+	bits.TrailingZeros64(flagStale),
+	bits.TrailingZeros64(flagWildcard),
+	prefixIndexKey,
+	prefixExpiryKey,
+	hashMetaField,
+	cascadeActionDelete,
+	cascadeActionExpire,
+	cascadeActionStale,
+	unboundedWildcardReply,
+))
+
+// Prefix of error reply of the script which refuses to expand wildcard key without max scanned keys
+const unboundedWildcardReply = "RCUNBOUNDED"
+
+// Lua script which shortens TTL of keys to ARGV[1] milliseconds. TTL which is already shorter is kept
+var shortenTTLScript = redis.NewScript(`
+for _, k in ipairs(KEYS) do
+	local ttl = redis.call("PTTL", k)
+	if ttl == -1 or ttl > tonumber(ARGV[1]) then
+		redis.call("PEXPIRE", k, ARGV[1])
+	end
+end
+return 0
+`)
+
+// Lua script which replaces KEYS[1] with ARGV[2] keeping TTL, only if it's still ARGV[1]
+var markStaleScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// Delete roots and relevant keys atomically by the script. Errors and expansions are recorded to w, and res is filled if it's not nil.
+// fallback is true only when the script can't be run on the server, e.g. scripting is disabled,
+// or wildcard key is reached without max scanned keys of wildcard budget.
+func (r *RedisCache) cascadeDelete(method string, roots []string, w *walkState, res *InvalidationResult) (deleted []string, fallback bool, err error) {
+	shadow := 0
+	if r.expiryCascade {
+		shadow = 1
+	}
+	index := 0
+	if r.prefixIndex {
+		index = 1
+	}
+	now := time.Now()
+	result, err := cascadeDeleteScript.Run(
+		r.conn, roots, method, r.maxDepth, shadow, staleSection(now),
+		index, r.budget.MaxScanned, r.budget.MaxMatches, now.UnixNano()/int64(time.Millisecond),
+	).Result()
+	if err != nil && strings.HasPrefix(err.Error(), unboundedWildcardReply) {
+		// Nothing is written by the script yet, and client-side walk expands wildcard keys without blocking the server
+		debug(r.w, fmt.Sprintf("[%s] wildcard key is not expanded by the script without max scanned keys, fallback to client-side walk: %s\n", method, err.Error()))
+		return nil, true, nil
+	} else if err != nil {
+		// Other errors are returned because the script might have deleted some keys before failing
+		if !isScriptingUnavailable(err) {
+			return nil, false, err
+		}
+		debug(r.w, fmt.Sprintf("[%s] failed to run cascade delete script, fallback to client-side walk: %s\n", method, err.Error()))
+		return nil, true, nil
+	}
+	reply, ok := result.([]interface{})
+	if !ok || len(reply) != 4 {
+		return nil, false, fmt.Errorf("unexpected reply of cascade delete script: %v", result)
+	}
+	deleted = replyStrings(reply[0])
+	if res != nil {
+		for _, k := range deleted {
+			res.resolve(k, true)
+		}
+		for _, k := range replyStrings(reply[3]) {
+			res.resolve(k, false)
+		}
+	}
+
+	var budgetErr error
+	expansions, _ := reply[2].([]interface{})
+	for _, v := range expansions {
+		e, _ := v.([]interface{})
+		if len(e) != 5 {
+			continue
+		}
+		scanned, _ := e[2].(int64)
+		err := w.expanded(WildcardExpansion{
+			From:    fmt.Sprint(e[0]),
+			Pattern: fmt.Sprint(e[1]),
+			Matched: replyStrings(e[4]),
+			Scanned: int(scanned),
+			Limit:   WildcardLimit(fmt.Sprint(e[3])),
+		})
+		if err != nil && budgetErr == nil {
+			budgetErr = err
+		}
+	}
+	if path := replyStrings(reply[1]); len(path) > 0 {
+		key := path[len(path)-1]
+		debug(r.w, fmt.Sprintf("[DEPTH] relations of %s are not followed over max depth %d\n", key, r.maxDepth))
+		return deleted, false, w.fail(key, &RelevanceDepthError{
+			Key:   key,
+			Depth: r.maxDepth,
+			Path:  path,
+		})
+	}
+	return deleted, false, budgetErr
+}
+
+// Report whether err is returned because the server can't run scripts, e.g. scripting is disabled or EVAL is renamed
+func isScriptingUnavailable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.HasPrefix(msg, "noscript"):
+	case strings.Contains(msg, "scripting is disabled"):
+	case strings.Contains(msg, "unknown command") && strings.Contains(msg, "eval"):
+	default:
+		return false
+	}
+	return true
+}
+
+// Convert array reply of the script to strings
+func replyStrings(v interface{}) []string {
+	values, _ := v.([]interface{})
+	s := make([]string, len(values))
+	for i, k := range values {
+		s[i] = fmt.Sprint(k)
+	}
+	return s
+}
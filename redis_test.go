@@ -1,8 +1,19 @@
 package relevantcache_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/assert"
 	rc "github.com/ysugimoto/relevantcache"
 )
@@ -244,6 +255,12 @@ func TestRedisCacheHGet(t *testing.T) {
 	v, err := c.HGet("hget_key01", "user01")
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("foobar"), v)
+
+	// Other types than string and []byte are encoded as RawCodec does
+	assert.NoError(t, c.HSet("hget_key01", "user02", []int{1, 2}))
+	v, err = c.HGet("hget_key01", "user02")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("[1 2]"), v)
 }
 
 func TestRedisCacheHGetWithRelevantKey(t *testing.T) {
@@ -259,3 +276,992 @@ func TestRedisCacheHGetWithRelevantKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("foobar"), v)
 }
+
+func TestRedisCacheGetValueWithCodec(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithCodec(rc.JSONCodec))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("user", 1).Value(user{Name: "foo", Age: 1})))
+	assert.NoError(t, c.Set(rc.NewItem("user", 2).Value(user{Name: "bar", Age: 2}).Codec(rc.GobCodec)))
+	defer func() {
+		c.Del("user_1", "user_2")
+	}()
+
+	var u user
+	assert.NoError(t, c.GetValue("user_1", &u))
+	assert.Equal(t, user{Name: "foo", Age: 1}, u)
+	assert.NoError(t, c.GetValue("user_2", &u))
+	assert.Equal(t, user{Name: "bar", Age: 2}, u)
+
+	// Codec of primitive value is recorded in the header, so reader with other codec decodes it
+	assert.NoError(t, c.Set("user_3", user{Name: "baz", Age: 3}))
+	defer c.Del("user_3")
+	r, _ := rc.NewRedisCache(redisUrl, rc.WithCodec(rc.GobCodec))
+	defer r.Close()
+	assert.NoError(t, r.GetValue("user_3", &u))
+	assert.Equal(t, user{Name: "baz", Age: 3}, u)
+	v, err := r.Get("user_3")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"Name":"baz","Age":3}`), v)
+}
+
+func TestRedisCacheSetAndGetWithCompression(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithCompression(rc.CompressionGzip, 64))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 100)
+	assert.NoError(t, c.Set("parent_1", large))
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value(large).RelevantTo("parent", 1)))
+	defer func() {
+		c.Del("child_10")
+	}()
+
+	raw, err := c.Conn().Get("child_10").Bytes()
+	assert.NoError(t, err)
+	assert.True(t, len(raw) < len(large))
+
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), v)
+	values, err := c.MGet("parent_1", "child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), values[0])
+	assert.Equal(t, []byte(large), values[1])
+
+	keys := c.FactoryRelevantKeys("child_10")
+	assert.Equal(t, []string{"child_10", "parent_1"}, keys)
+}
+
+func TestRedisCacheSetAndGetWithSplitBuffer(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(100))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 30)
+	assert.NoError(t, c.Set("parent_1", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value(large).RelevantTo("parent", 1)))
+
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), v)
+	values, err := c.MGet("child_10", "parent_1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), values[0])
+	assert.Equal(t, []byte("parent"), values[1])
+
+	assert.NoError(t, c.Unlink("child_10"))
+	for _, k := range []string{"child_10", "child_10:chunk:0", "child_10:chunk:3", "parent_1"} {
+		err = c.Conn().Get(k).Err()
+		assert.Error(t, err)
+	}
+}
+
+func TestRedisCacheConcurrentSetWithSplitBuffer(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(10))
+	defer c.Close()
+
+	// Writers of different sizes race, and only chunks of the last record are left
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				err := c.Set(rc.NewItem("race").Value(strings.Repeat("v", size*10+5)))
+				if err != nil {
+					assert.Equal(t, redis.TxFailedErr, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	e, err := c.GetWithMeta("race")
+	assert.NoError(t, err)
+	keys, err := c.Conn().Keys("race:chunk:*").Result()
+	assert.NoError(t, err)
+	assert.Len(t, keys, (len(e.Value)+9)/10)
+	assert.NoError(t, c.Del("race"))
+}
+
+func TestRedisCacheDetectCorruptRecord(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithCorruptRecordPolicy(rc.CorruptRecordDelete))
+	defer c.Close()
+
+	b := rc.EncodeItemWithChecksum(rc.NewItem("child", 10).Value("child").RelevantTo("parent", 1))
+	b[len(b)-1] = 'X'
+	assert.NoError(t, c.Conn().Set("child_10", b, 0).Err())
+
+	_, err := c.Get("child_10")
+	assert.True(t, errors.Is(err, rc.ErrCorruptRecord))
+	err = c.Conn().Get("child_10").Err()
+	assert.Error(t, err)
+}
+
+func TestRedisCacheRelevantKeyContainsDelimiter(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	assert.NoError(t, c.Set("parent|1", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("child", 10).Value("child").RelevantTo("parent|1")))
+
+	assert.NoError(t, c.Del("child_10"))
+	err := c.Conn().Get("parent|1").Err()
+	assert.Error(t, err)
+}
+
+func TestRedisCacheGetWithMeta(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithOrigin("api"))
+	defer c.Close()
+
+	item := rc.NewItem("child", 10).Value("child").RelevantTo("parent", 1).Version(3).Tags("catalog")
+	assert.NoError(t, c.Set(item))
+	defer func() {
+		c.Del("child_10")
+	}()
+
+	e, err := c.GetWithMeta("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("child"), e.Value)
+	assert.Equal(t, []string{"parent_1"}, e.RelevantKeys)
+	assert.Equal(t, int64(3), e.Version)
+	assert.Equal(t, []string{"catalog"}, e.Tags)
+	assert.Equal(t, "api", e.Origin)
+	assert.False(t, e.CreatedAt.IsZero())
+}
+
+func TestRedisCacheSetAndGetStream(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(100), rc.WithCompression(rc.CompressionGzip, 0), rc.WithChecksum(true))
+	defer c.Close()
+
+	large := strings.Repeat("lorem ipsum ", 100)
+	assert.NoError(t, c.Set("parent_1", "parent"))
+	assert.NoError(t, c.SetStream(rc.NewItem("child", 10).RelevantTo("parent", 1), strings.NewReader(large)))
+
+	r, err := c.GetStream("child_10")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, large, string(b))
+
+	v, err := c.Get("child_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(large), v)
+
+	assert.NoError(t, c.Del("child_10"))
+	for _, k := range []string{"child_10", "child_10:chunk:0", "parent_1"} {
+		err = c.Conn().Get(k).Err()
+		assert.Error(t, err)
+	}
+	_, err = c.GetStream("child_10")
+	assert.Equal(t, rc.RedisNil, err)
+}
+
+// Reader which calls fn before each read, to run something while streaming or interrupt it
+type hookReader struct {
+	r  io.Reader
+	fn func() error
+}
+
+func (h *hookReader) Read(p []byte) (int, error) {
+	if err := h.fn(); err != nil {
+		return 0, err
+	}
+	return h.r.Read(p)
+}
+
+func TestRedisCacheSetStreamOverwrite(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(100), rc.WithChecksum(true))
+	defer c.Close()
+
+	old := strings.Repeat("old ", 300)
+	assert.NoError(t, c.Set(rc.NewItem("stream_over").Value(old)))
+
+	// Readers see the old record with its chunks until the new record is stored
+	reads := 0
+	src := &hookReader{r: strings.NewReader(strings.Repeat("new ", 300)), fn: func() error {
+		if reads++; reads == 5 {
+			v, err := c.Get("stream_over")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(old), v)
+		}
+		return nil
+	}}
+	assert.NoError(t, c.SetStream(rc.NewItem("stream_over").Ttl(60), src))
+	v, err := c.Get("stream_over")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(strings.Repeat("new ", 300)), v)
+	ttl, err := c.Conn().TTL("stream_over:chunk:0").Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	// Chunks which are written before failure are deleted, and the old record is kept
+	reads = 0
+	src = &hookReader{r: strings.NewReader(strings.Repeat("bad ", 300)), fn: func() error {
+		if reads++; reads == 5 {
+			return errors.New("source failed")
+		}
+		return nil
+	}}
+	assert.Error(t, c.SetStream(rc.NewItem("stream_over"), src))
+	v, err = c.Get("stream_over")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(strings.Repeat("new ", 300)), v)
+	keys, err := c.Conn().Keys("__rc:stream:*").Result()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	assert.NoError(t, c.Del("stream_over"))
+	keys, err = c.Conn().Keys("stream_over*").Result()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestRedisCacheGetStreamWithoutChunks(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	// Larger than GETRANGE window
+	large := strings.Repeat("lorem ipsum ", 10000)
+	assert.NoError(t, c.SetStream(rc.NewItem("child", 10).RelevantTo("parent", 1), strings.NewReader(large)))
+	assert.NoError(t, c.Set("plain", "value"))
+	defer func() {
+		c.Del("child_10", "plain")
+	}()
+
+	for k, expect := range map[string]string{"child_10": large, "plain": "value"} {
+		r, err := c.GetStream(k)
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(b))
+	}
+}
+
+func TestRedisCacheMigrate(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	legacy := append([]byte{'$', 0, 0, 8}, []byte("parent|1child")...)
+	assert.NoError(t, c.Conn().Set("migrate_10", legacy, time.Minute).Err())
+	assert.NoError(t, c.Conn().Set("migrate_20", "value", 0).Err())
+	assert.NoError(t, c.Conn().HSet("migrate_30", "field", "value").Err())
+	defer func() {
+		c.Conn().Del("migrate_10", "migrate_20", "migrate_30")
+	}()
+
+	report, err := rc.Migrate(context.Background(), c, rc.FormatLegacy, rc.FormatV2, rc.WithMigrationMatch("migrate_*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Equal(t, 1, report.Migrated)
+	assert.Equal(t, 2, report.Unmatched)
+
+	v, err := c.Get("migrate_10")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("child"), v)
+	b, err := c.Conn().Get("migrate_10").Bytes()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "$rc"))
+	ttl, err := c.Conn().TTL("migrate_10").Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+}
+
+func TestRedisCacheEncryptionKeyRotation(t *testing.T) {
+	k1 := []byte(strings.Repeat("1", 32))
+	k2 := []byte(strings.Repeat("2", 16))
+	old, _ := rc.NewKeyring("k1", map[string][]byte{"k1": k1})
+	rotated, _ := rc.NewKeyring("k2", map[string][]byte{"k1": k1, "k2": k2})
+
+	c1, _ := rc.NewRedisCache(redisUrl, rc.WithEncryption(old))
+	defer c1.Close()
+	c2, _ := rc.NewRedisCache(redisUrl, rc.WithEncryption(rotated))
+	defer c2.Close()
+	c3, _ := rc.NewRedisCache(redisUrl)
+	defer c3.Close()
+
+	assert.NoError(t, c1.Set("parent_1", "parent"))
+	assert.NoError(t, c1.Set(rc.NewItem("child", 10).Value("secret").RelevantTo("parent", 1)))
+	assert.NoError(t, c1.HSet("hash", "field", "secret"))
+	defer func() {
+		c1.Conn().Del("hash")
+	}()
+	b, err := c1.Conn().Get("child_10").Bytes()
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(b), "secret"))
+
+	// Old key is still usable to decrypt during rotation
+	values, err := c2.MGet("child_10", "parent_1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), values[0])
+	assert.Equal(t, []byte("parent"), values[1])
+	v, err := c2.HGet("hash", "field")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), v)
+
+	// Rewritten record is encrypted by the new key
+	assert.NoError(t, c2.Set(rc.NewItem("child", 10).Value("secret").RelevantTo("parent", 1)))
+	_, err = c1.Get("child_10")
+	assert.Error(t, err)
+	_, err = c3.Get("child_10")
+	assert.Error(t, err)
+
+	// Relevant keys are readable without data key
+	assert.NoError(t, c3.Del("child_10"))
+	err = c3.Conn().Get("parent_1").Err()
+	assert.Error(t, err)
+}
+
+func TestRedisCacheDelDependents(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	assert.NoError(t, c.Set("user_42", "user"))
+	assert.NoError(t, c.Set(rc.NewItem("profile", 42).Value("profile").DependsOn("user", 42).Ttl(60)))
+	assert.NoError(t, c.Set(rc.NewItem("feed", 42).Value("feed").DependsOn("user", 42).Ttl(30)))
+	assert.NoError(t, c.Set(rc.NewItem("badge", 42).Value("badge").DependsOn("profile", 42)))
+
+	// Index lives as long as the dependent which lives longest
+	ttl, err := c.Conn().TTL("__rc:dependents:user_42").Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 30*time.Second)
+	ttl, err = c.Conn().TTL("__rc:dependents:profile_42").Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl < 0)
+
+	assert.NoError(t, c.Del("feed_42"))
+	members, err := c.Conn().SMembers("__rc:dependents:user_42").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"profile_42"}, members)
+
+	assert.NoError(t, c.Unlink("user_42"))
+	for _, k := range []string{"user_42", "profile_42", "badge_42", "__rc:dependents:user_42", "__rc:dependents:profile_42"} {
+		n, err := c.Conn().Exists(k).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n, k)
+	}
+}
+
+func TestRedisCacheDelRelevanceCycle(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithMaxRelevanceDepth(3))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("cycle_a").Value("a").RelevantTo("cycle_b")))
+	assert.NoError(t, c.Set(rc.NewItem("cycle_b").Value("b").RelevantTo("cycle_c")))
+	assert.NoError(t, c.Set(rc.NewItem("cycle_c").Value("c").RelevantTo("cycle_a")))
+
+	assert.Equal(t, []string{"cycle_a", "cycle_b", "cycle_c"}, c.FactoryRelevantKeys("cycle_a"))
+	assert.NoError(t, c.Del("cycle_b"))
+	n, err := c.Conn().Exists("cycle_a", "cycle_b", "cycle_c").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestRedisCacheFactoryRelevantKeysByLevel(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	// 6 levels of chain, and first level also has 10 leaves
+	item := rc.NewItem("chain", 0).Value("v").RelevantTo("chain", 1)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, c.Set(fmt.Sprintf("leaf_%d", i), "v"))
+		item.RelevantTo("leaf", i)
+	}
+	assert.NoError(t, c.Set(item))
+	for i := 1; i < 5; i++ {
+		assert.NoError(t, c.Set(rc.NewItem("chain", i).Value("v").RelevantTo("chain", i+1)))
+	}
+	assert.NoError(t, c.Set(rc.NewItem("chain", 5).Value("v").DependsOn("chain", 4)))
+
+	pipelines := 0
+	commands := 0
+	c.Conn().WrapProcessPipeline(func(old func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			pipelines++
+			return old(cmds)
+		}
+	})
+	c.Conn().WrapProcess(func(old func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			commands++
+			return old(cmd)
+		}
+	})
+
+	keys := c.FactoryRelevantKeys("chain_0")
+	assert.Len(t, keys, 17)
+	assert.Equal(t, "chain_0", keys[0])
+	assert.Equal(t, 6, pipelines)
+	assert.Equal(t, 0, commands)
+
+	assert.NoError(t, c.Del("chain_0"))
+	n, err := c.Conn().Exists(keys...).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestRedisCacheAtomicDelete(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithAtomicDelete(true), rc.WithSplitBufferSize(8))
+	defer c.Close()
+
+	// legacy record is relevant to parent
+	assert.NoError(t, c.Conn().Set("atomic_legacy", "$\x00\x00\x0datomic_parentlegacy", 0).Err())
+	assert.NoError(t, c.Set(rc.NewItem("atomic_parent").Value("parent").RelevantTo("atomic_root")))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_root").Value("root value which is split into chunks")))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_dependent").Value("dependent").DependsOn("atomic_root")))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_stale").Value("stale").DependsOn("atomic_root")))
+	// overwritten record doesn't depend on root anymore
+	assert.NoError(t, c.Set(rc.NewItem("atomic_stale").Value("stale")))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_other").Value("other").DependsOn("atomic_parent")))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_tagged").Value("tagged").Origin("api").Tags("atomic:tag").DependsOn("atomic_root")))
+
+	assert.NoError(t, c.Del("atomic_legacy"))
+	keys, err := c.Conn().Keys("atomic_*").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"atomic_stale"}, keys)
+	// Deleted keys are removed from tag index as the client-side walk does
+	for _, k := range []string{"__rc:dependents:atomic_root", "__rc:dependents:atomic_parent", "atomic_root:chunk:0", "__rc:tag:atomic:tag"} {
+		n, err := c.Conn().Exists(k).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n, k)
+	}
+	assert.NoError(t, c.Unlink("atomic_stale"))
+}
+
+func TestRedisCacheAtomicDeleteOverMaxRelevanceDepth(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithAtomicDelete(true), rc.WithMaxRelevanceDepth(2))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("atomic_depth", 0).Value("v").RelevantTo("atomic_depth", 1)))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_depth", 1).Value("v").RelevantTo("atomic_depth", 2)))
+	assert.NoError(t, c.Set(rc.NewItem("atomic_depth", 2).Value("v").RelevantTo("atomic_depth", 3)))
+	assert.NoError(t, c.Set("atomic_depth_3", "v"))
+
+	err := c.Del("atomic_depth_0")
+	assert.True(t, errors.Is(err, rc.ErrRelevanceDepthExceeded))
+	var de *rc.RelevanceDepthError
+	assert.True(t, errors.As(err, &de))
+	assert.Equal(t, "atomic_depth_2", de.Key)
+	assert.Equal(t, []string{"atomic_depth_0", "atomic_depth_1", "atomic_depth_2"}, de.Path)
+
+	// Keys within max depth are deleted
+	keys, err := c.Conn().Keys("atomic_depth_*").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"atomic_depth_3"}, keys)
+	assert.NoError(t, c.Del("atomic_depth_3"))
+}
+
+func TestRedisCacheResolve(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(8))
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("plan_child").Value("child").RelevantTo("plan_parent")))
+	assert.NoError(t, c.Set(rc.NewItem("plan_parent").Value("parent").RelevantTo("plan_list_*")))
+	assert.NoError(t, c.Set("plan_list_1", "1"))
+	assert.NoError(t, c.Set(rc.NewItem("plan_view").Value("view contents").DependsOn("plan_child")))
+
+	plan, err := c.Resolve("plan_child")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plan_child", "__rc:dependents:plan_child", "plan_parent", "plan_view", "plan_view:chunk:0", "plan_view:chunk:1", "plan_list_1"}, plan.Keys)
+	assert.Equal(t, []rc.InvalidationEdge{
+		{From: "plan_parent", To: "plan_list_1", Kind: rc.EdgeRelevant, Pattern: "plan_list_*"},
+	}, plan.EdgesTo("plan_list_1"))
+	assert.Equal(t, []rc.InvalidationEdge{
+		{From: "plan_child", To: "plan_view", Kind: rc.EdgeDependent},
+	}, plan.EdgesTo("plan_view"))
+	assert.Equal(t, []rc.InvalidationEdge{
+		{From: "plan_view", To: "plan_view:chunk:0", Kind: rc.EdgeChunk},
+	}, plan.EdgesTo("plan_view:chunk:0"))
+	assert.Equal(t, []string{"plan_list_1"}, plan.WildcardKeys())
+
+	// Nothing is deleted
+	n, err := c.Conn().Exists(plan.Keys...).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(plan.Keys)), n)
+	assert.NoError(t, c.Del("plan_child"))
+}
+
+func TestRedisCacheExportGraph(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithSplitBufferSize(8))
+	defer c.Close()
+
+	assert.NoError(t, c.Purge())
+	assert.NoError(t, c.Set(rc.NewItem("graph_child").Value("child").RelevantTo("graph_parent").Ttl(60)))
+	assert.NoError(t, c.Set(rc.NewItem("graph_view").Value("view contents").DependsOn("graph_child")))
+	assert.NoError(t, c.HSet(rc.NewItem("graph_hash").RelevantTo("graph_child"), "field", "value"))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, c.ExportGraph(buf, rc.GraphJSON))
+	var g rc.Graph
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &g))
+	keys := []string{}
+	for _, n := range g.Nodes {
+		keys = append(keys, n.Key)
+	}
+	// dependents index is not included
+	assert.Equal(t, []string{"graph_child", "graph_hash", "graph_view", "graph_view:chunk:0", "graph_view:chunk:1"}, keys)
+	assert.True(t, g.Nodes[0].TTL > 59000)
+	assert.Equal(t, 0, g.Nodes[1].Size)
+	assert.Equal(t, []rc.GraphEdge{
+		{From: "graph_child", To: "graph_parent", Kind: rc.EdgeRelevant},
+		{From: "graph_hash", To: "graph_child", Kind: rc.EdgeRelevant},
+		{From: "graph_view", To: "graph_view:chunk:0", Kind: rc.EdgeChunk},
+		{From: "graph_view", To: "graph_view:chunk:1", Kind: rc.EdgeChunk},
+		{From: "graph_child", To: "graph_view", Kind: rc.EdgeDependent},
+	}, g.Edges)
+}
+
+func TestRedisCacheExportGraphWithLongHeader(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	assert.NoError(t, c.Purge())
+	// Header is longer than the first GETRANGE window
+	item := rc.NewItem("graph_long").Value(strings.Repeat("v", 100))
+	parents := []string{}
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("graph_parent_%03d_%s", i, strings.Repeat("p", 60))
+		item.RelevantTo(k)
+		parents = append(parents, k)
+	}
+	assert.NoError(t, c.Set(item))
+	size, err := c.Conn().StrLen("graph_long").Result()
+	assert.NoError(t, err)
+	assert.True(t, size > 4096)
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, c.ExportGraph(buf, rc.GraphJSON))
+	var g rc.Graph
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &g))
+	assert.Equal(t, []rc.GraphNode{{Key: "graph_long", TTL: -1, Size: int(size)}}, g.Nodes)
+	to := []string{}
+	for _, e := range g.Edges {
+		to = append(to, e.To)
+	}
+	assert.Equal(t, parents, to)
+	assert.NoError(t, c.Del("graph_long"))
+}
+
+func TestRedisCacheInvalidateTags(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	assert.NoError(t, c.Set("tag_parent", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("tag_product").Value("product").Tags("product:12", "catalog").RelevantTo("tag_parent").Ttl(60)))
+	assert.NoError(t, c.Set(rc.NewItem("tag_list").Value("list").Tags("catalog")))
+	assert.NoError(t, c.Set(rc.NewItem("tag_other").Value("other").Tags("catalog")))
+	// overwritten record doesn't have the tag anymore
+	assert.NoError(t, c.Set(rc.NewItem("tag_other").Value("other")))
+	assert.NoError(t, c.Set(rc.NewItem("tag_view").Value("view").DependsOn("tag_list")))
+
+	members, err := c.Conn().SMembers("__rc:tag:catalog").Result()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"tag_product", "tag_list", "tag_other"}, members)
+
+	assert.NoError(t, c.InvalidateTags("product:12"))
+	n, err := c.Conn().Exists("tag_product", "tag_parent", "__rc:tag:product:12").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	// deleted key is removed from other tags
+	members, err = c.Conn().SMembers("__rc:tag:catalog").Result()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"tag_list", "tag_other"}, members)
+
+	assert.NoError(t, c.InvalidateTags("catalog"))
+	n, err = c.Conn().Exists("tag_list", "tag_view", "__rc:tag:catalog").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	n, err = c.Conn().Exists("tag_other").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, c.Del("tag_other"))
+}
+
+func TestRedisCacheExpiredEventsEnabled(t *testing.T) {
+	for flags, enabled := range map[string]bool{
+		"xE":  true,
+		"Ex":  true,
+		"AKE": true,
+		"KEA": true,
+		"AK":  false,
+		"Kx":  false,
+		"E":   false,
+		"":    false,
+	} {
+		assert.Equal(t, enabled, rc.ExpiredEventsEnabled(flags), "flags: %q", flags)
+	}
+}
+
+func TestRedisCacheExpiryCascade(t *testing.T) {
+	c, err := rc.NewRedisCache(redisUrl, rc.WithExpiryCascade(true))
+	assert.NoError(t, err)
+	defer c.Close()
+
+	assert.NoError(t, c.Set("expiry_parent", "parent"))
+	assert.NoError(t, c.Set(rc.NewItem("expiry_child").Value("child").RelevantTo("expiry_parent").Ttl(60)))
+	assert.NoError(t, c.Set(rc.NewItem("expiry_view").Value("view").DependsOn("expiry_child")))
+
+	ttl, err := c.Conn().TTL("__rc:shadow:expiry_child").Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 60*time.Second)
+
+	// Simulate expiration of the record, shadow record is still alive
+	assert.NoError(t, c.Conn().Del("expiry_child").Err())
+	assert.NoError(t, c.Conn().Publish("__keyevent@0__:expired", "expiry_child").Err())
+	assert.Eventually(t, func() bool {
+		n, err := c.Conn().Exists("expiry_parent", "expiry_view", "__rc:shadow:expiry_child", "__rc:dependents:expiry_child").Result()
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Expiration is claimed by the process which cascades it, so the same event is not cascaded again
+	assert.NoError(t, c.Set(rc.NewItem("expiry_view").Value("view").DependsOn("expiry_child")))
+	assert.NoError(t, c.Conn().Publish("__keyevent@0__:expired", "expiry_child").Err())
+	// Chunk keys don't cascade by themselves
+	assert.NoError(t, c.Set(rc.NewItem("expiry_chunk").Value("chunk").DependsOn("expiry_child:chunk:0")))
+	assert.NoError(t, c.Conn().Publish("__keyevent@0__:expired", "expiry_child:chunk:0").Err())
+	time.Sleep(100 * time.Millisecond)
+	n, err := c.Conn().Exists("expiry_view", "expiry_chunk").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// Setting the key again removes the claim
+	assert.NoError(t, c.Set(rc.NewItem("expiry_child").Value("child").Ttl(60)))
+	assert.NoError(t, c.Conn().Del("expiry_child").Err())
+	assert.NoError(t, c.Conn().Publish("__keyevent@0__:expired", "expiry_child").Err())
+	assert.Eventually(t, func() bool {
+		n, err := c.Conn().Exists("expiry_view").Result()
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, c.Del("expiry_chunk"))
+
+	// Subscription is stopped
+	assert.NoError(t, c.Close())
+}
+
+func TestRedisCacheCascadeActions(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		c, _ := rc.NewRedisCache(redisUrl, rc.WithAtomicDelete(atomic), rc.WithSplitBufferSize(8))
+
+		assert.NoError(t, c.Set(rc.NewItem("action_stale").Value("stale value which is split").Ttl(60)))
+		assert.NoError(t, c.Set("action_expire", "expire"))
+		assert.NoError(t, c.Set("action_both", "both"))
+		assert.NoError(t, c.Set(rc.NewItem("action_mid").Value("mid").RelevantTo("action_both")))
+		assert.NoError(t, c.Set(rc.NewItem("action_view").Value("view").DependsOn("action_root").OnCascade(rc.CascadeStale)))
+		assert.NoError(t, c.Set(rc.NewItem("action_root").Value("root").
+			CascadeTo(rc.CascadeStale, "action_stale").
+			CascadeTo(rc.CascadeExpire(time.Second), "action_expire").
+			CascadeTo(rc.CascadeStale, "action_both").
+			RelevantTo("action_mid")))
+
+		plan, err := c.Resolve("action_root")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]rc.CascadeAction{
+			"action_stale":  rc.CascadeStale,
+			"action_expire": rc.CascadeExpire(time.Second),
+			"action_view":   rc.CascadeStale,
+		}, plan.Actions)
+
+		assert.NoError(t, c.Del("action_root"))
+		// action_both is deleted because it's also reached by action_mid
+		for _, k := range []string{"action_root", "action_mid", "action_both"} {
+			n, err := c.Conn().Exists(k).Result()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), n, k)
+		}
+		for _, k := range []string{"action_stale", "action_view"} {
+			_, err := c.Get(k)
+			assert.Equal(t, redis.Nil, err, k)
+		}
+		v, stale, err := c.GetStale("action_stale")
+		assert.NoError(t, err)
+		assert.True(t, stale)
+		assert.Equal(t, []byte("stale value which is split"), v)
+		ttl, err := c.Conn().PTTL("action_stale").Result()
+		assert.NoError(t, err)
+		assert.True(t, ttl > time.Second, "atomic: %v", atomic)
+		_, stale, err = c.GetStale("action_view")
+		assert.NoError(t, err)
+		assert.True(t, stale)
+
+		ttl, err = c.Conn().PTTL("action_expire").Result()
+		assert.NoError(t, err)
+		assert.True(t, ttl > 0 && ttl <= time.Second, "atomic: %v", atomic)
+		v, err = c.Get("action_expire")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("expire"), v)
+
+		assert.NoError(t, c.Del("action_stale", "action_expire", "action_view"))
+		c.Close()
+	}
+}
+
+func TestRedisCacheWildcardBudget(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		c, _ := rc.NewRedisCache(redisUrl,
+			rc.WithAtomicDelete(atomic),
+			rc.WithPrefixIndex(true),
+			rc.WithWildcardBudget(rc.WildcardBudget{MaxMatches: 2}),
+		)
+
+		for _, k := range []string{"wc_1", "wc_2", "wc_3", "wc_lit*", "wc_lit1"} {
+			assert.NoError(t, c.Set(k, "v"))
+		}
+		assert.NoError(t, c.Set(rc.NewItem("wc_root").Value("root").RelevantMatch("wc_?").RelevantExact("wc_lit*")))
+
+		err := c.Del("wc_root")
+		assert.True(t, errors.Is(err, rc.ErrWildcardBudgetExceeded))
+		var be *rc.WildcardBudgetError
+		assert.True(t, errors.As(err, &be))
+		assert.Equal(t, "wc_?", be.Pattern)
+		assert.Equal(t, rc.WildcardMaxMatches, be.Limit)
+		assert.Equal(t, 2, be.Matched)
+
+		// Index is listed in lexical order, and wc_lit* is matched exactly
+		keys, err := c.Conn().Keys("wc_*").Result()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"wc_3", "wc_lit1"}, keys)
+		members, err := c.Conn().ZRangeByLex("__rc:prefix", redis.ZRangeBy{Min: "[wc_", Max: "(wc`"}).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"wc_3", "wc_lit1"}, members)
+
+		assert.NoError(t, c.Conn().Del("wc_3", "wc_lit1", "__rc:prefix").Err())
+		c.Close()
+	}
+}
+
+// Matches up to max matches are completed without error on every expansion
+func TestRedisCacheWildcardBudgetExactMatches(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		for _, index := range []bool{false, true} {
+			c, _ := rc.NewRedisCache(redisUrl,
+				rc.WithAtomicDelete(atomic),
+				rc.WithPrefixIndex(index),
+				rc.WithWildcardBudget(rc.WildcardBudget{MaxMatches: 2}),
+			)
+
+			for _, k := range []string{"wcx_1", "wcx_2", "wcx_other"} {
+				assert.NoError(t, c.Set(k, "v"))
+			}
+			assert.NoError(t, c.Set(rc.NewItem("wcx_root").Value("root").RelevantMatch("wcx_?")))
+
+			assert.NoError(t, c.Del("wcx_root"), "atomic: %v, index: %v", atomic, index)
+			keys, err := c.Conn().Keys("wcx_*").Result()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"wcx_other"}, keys)
+
+			assert.NoError(t, c.Conn().Del("wcx_other", "__rc:prefix").Err())
+			c.Close()
+		}
+	}
+}
+
+func TestRedisCachePrefixIndex(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		c, _ := rc.NewRedisCache(redisUrl,
+			rc.WithAtomicDelete(atomic),
+			rc.WithPrefixIndex(true),
+			rc.WithWildcardBudget(rc.WildcardBudget{MaxScanned: 100}),
+		)
+
+		assert.NoError(t, c.Set(rc.NewItem("px_1").Value("v").Ttl(60)))
+		assert.NoError(t, c.Set("px_2", "v"))
+		assert.NoError(t, c.Set(rc.NewItem("pxroot").Value("root").RelevantAll("px")))
+		score, err := c.Conn().ZScore("__rc:prefix:expiry", "px_1").Result()
+		assert.NoError(t, err)
+		assert.True(t, score > float64(time.Now().Add(59*time.Second).UnixNano()/int64(time.Millisecond)))
+		assert.Equal(t, redis.Nil, c.Conn().ZScore("__rc:prefix:expiry", "px_2").Err())
+
+		// Simulate expiration of px_1, its member is pruned before expansion
+		assert.NoError(t, c.Conn().Del("px_1").Err())
+		assert.NoError(t, c.Conn().ZAdd("__rc:prefix:expiry", redis.Z{Score: 1, Member: "px_1"}).Err())
+		res, err := c.DelWithResult("pxroot")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"px_2"}, res.Expansions[0].Matched, "atomic: %v", atomic)
+		assert.Empty(t, res.Missing)
+
+		// Keys which are set by other clients are indexed by backfill, and members of missing keys are removed
+		assert.NoError(t, c.Conn().Set("px_raw", "raw", time.Minute).Err())
+		assert.NoError(t, c.Conn().ZAdd("__rc:prefix", redis.Z{Member: "px_dead"}).Err())
+		_, err = c.BuildPrefixIndex()
+		assert.NoError(t, err)
+		members, err := c.Conn().ZRangeByLex("__rc:prefix", redis.ZRangeBy{Min: "[px_", Max: "(px`"}).Result()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"px_raw"}, members)
+		_, err = c.Conn().ZScore("__rc:prefix:expiry", "px_raw").Result()
+		assert.NoError(t, err)
+
+		assert.NoError(t, c.Del("px_raw"))
+		n, err := c.Conn().Exists("__rc:prefix", "__rc:prefix:expiry").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+		c.Close()
+	}
+}
+
+func TestRedisCacheDelWithResult(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		c, _ := rc.NewRedisCache(redisUrl, rc.WithAtomicDelete(atomic), rc.WithMaxRelevanceDepth(2))
+
+		assert.NoError(t, c.Set(rc.NewItem("result_root").Value("root").RelevantTo("result_child").RelevantTo("result_gone")))
+		assert.NoError(t, c.Set(rc.NewItem("result_child").Value("child").RelevantTo("result_leaf").RelevantAll("result_match")))
+		assert.NoError(t, c.Set(rc.NewItem("result_leaf").Value("leaf").RelevantTo("result_deep")))
+		assert.NoError(t, c.Set("result_match_1", "match"))
+		assert.NoError(t, c.Set("result_deep", "deep"))
+
+		res, err := c.UnlinkWithResult("result_root", 42)
+		assert.True(t, errors.Is(err, rc.ErrRelevanceDepthExceeded))
+		assert.Equal(t, []string{"result_root"}, res.Requested)
+		assert.ElementsMatch(t, []string{"result_root", "result_child", "result_leaf", "result_match_1"}, res.Removed)
+		assert.Equal(t, []string{"result_gone"}, res.Missing)
+		assert.Len(t, res.Resolved, 5)
+		assert.Len(t, res.Errors, 2)
+		assert.True(t, errors.Is(res.Errors["result_leaf"], rc.ErrRelevanceDepthExceeded))
+		assert.Error(t, res.Errors["42"])
+		assert.Equal(t, []rc.WildcardExpansion{{
+			From:    "result_child",
+			Pattern: "result_match_*",
+			Matched: []string{"result_match_1"},
+			Scanned: res.Expansions[0].Scanned,
+		}}, res.Expansions)
+
+		assert.NoError(t, c.Del("result_deep"))
+		c.Close()
+	}
+}
+
+func TestRedisCacheDelWithResultErrors(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("fail_root").Value("root").RelevantTo("fail_child")))
+	assert.NoError(t, c.Set("fail_child", "child"))
+	// Broken index makes fetching dependents fail
+	assert.NoError(t, c.Conn().Set("__rc:dependents:fail_child", "broken", 0).Err())
+
+	res, err := c.DelWithResult("fail_root")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"fail_root"}, res.Removed)
+	assert.Empty(t, res.Missing)
+	assert.Len(t, res.Errors, 1)
+	assert.Error(t, res.Errors["fail_child"])
+
+	// Key which can't be fetched is not deleted
+	n, err := c.Conn().Exists("fail_child").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.NoError(t, c.Conn().Del("fail_child", "__rc:dependents:fail_child").Err())
+
+	// Failure of expanding the pattern is returned as well
+	ic, _ := rc.NewRedisCache(redisUrl, rc.WithPrefixIndex(true))
+	defer ic.Close()
+	assert.NoError(t, ic.Set(rc.NewItem("fail_root").Value("root").RelevantAll("fail_match")))
+	assert.NoError(t, ic.Conn().Set("__rc:prefix", "broken", 0).Err())
+	plan, err := ic.Resolve("fail_root")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"fail_root"}, plan.Keys)
+
+	assert.NoError(t, ic.Conn().Del("fail_root", "__rc:prefix").Err())
+}
+
+func TestRedisCacheDelAfter(t *testing.T) {
+	worker, _ := rc.NewRedisCache(redisUrl, rc.WithScheduleWorker(10*time.Millisecond))
+	defer worker.Close()
+	c, _ := rc.NewRedisCache(redisUrl)
+	defer c.Close()
+
+	assert.NoError(t, c.Set(rc.NewItem("schedule_root").Value("root").RelevantTo("schedule_child")))
+	assert.NoError(t, c.Set("schedule_child", "child"))
+
+	// Scheduled by the client without worker, and deleted by the worker
+	assert.NoError(t, c.DelAfter(50*time.Millisecond, "schedule_root"))
+	n, err := c.Conn().Exists("schedule_root").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	assert.Eventually(t, func() bool {
+		n, err := c.Conn().Exists("schedule_root", "schedule_child").Result()
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+	_, err = c.Conn().ZScore("__rc:schedule", "schedule_root").Result()
+	assert.Equal(t, redis.Nil, err)
+	_, err = c.Conn().ZScore("__rc:schedule:lease", "schedule_root").Result()
+	assert.Equal(t, redis.Nil, err)
+
+	// Failed deletion keeps the lease, and it's retried after the lease expires
+	assert.NoError(t, c.Set("schedule_fail", "fail"))
+	assert.NoError(t, c.Conn().Set("__rc:dependents:schedule_fail", "broken", 0).Err())
+	assert.NoError(t, c.DelAfter(0, "schedule_fail"))
+	assert.Eventually(t, func() bool {
+		score, err := c.Conn().ZScore("__rc:schedule:lease", "schedule_fail").Result()
+		return err == nil && score > float64(time.Now().UnixNano()/int64(time.Millisecond))
+	}, time.Second, 10*time.Millisecond)
+	n, err = c.Conn().Exists("schedule_fail").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	assert.NoError(t, c.Conn().Del("__rc:dependents:schedule_fail").Err())
+	assert.NoError(t, c.Conn().ZAdd("__rc:schedule:lease", redis.Z{Score: 1, Member: "schedule_fail"}).Err())
+	assert.Eventually(t, func() bool {
+		n, err := c.Conn().Exists("schedule_fail", "__rc:schedule:lease").Result()
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisCacheDoubleDelete(t *testing.T) {
+	c, _ := rc.NewRedisCache(redisUrl, rc.WithDoubleDelete(30*time.Millisecond))
+
+	assert.NoError(t, c.Set(rc.NewItem("double_root").Value("root").RelevantTo("double_child")))
+	assert.NoError(t, c.Set("double_child", "child"))
+	assert.NoError(t, c.Unlink("double_root"))
+	assert.NoError(t, c.Del("double_pending"))
+	// Stale data is written back by a reader after the first deletion
+	assert.NoError(t, c.Set(rc.NewItem("double_root").Value("stale").RelevantTo("double_child")))
+	assert.NoError(t, c.Set("double_child", "stale"))
+
+	assert.Eventually(t, func() bool {
+		n, err := c.Conn().Exists("double_root", "double_child").Result()
+		return err == nil && n == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return c.DoubleDeleteStats().Executed == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Pending second deletions are canceled on Close
+	assert.NoError(t, c.Del("double_pending"))
+	assert.NoError(t, c.Close())
+	assert.Equal(t, rc.DoubleDeleteStats{
+		Scheduled: 3,
+		Executed:  2,
+		Canceled:  1,
+	}, c.DoubleDeleteStats())
+}
+
+func TestRedisCacheHashRelevance(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		c, _ := rc.NewRedisCache(redisUrl, rc.WithAtomicDelete(atomic))
+
+		assert.NoError(t, c.HSet(rc.NewItem("hash_profile").RelevantTo("hash_child"), "name", "john"))
+		assert.NoError(t, c.HSet("hash_profile", "age", "20"))
+		assert.NoError(t, c.Set("hash_child", "child"))
+		assert.NoError(t, c.Set(rc.NewItem("hash_view").Value("view").DependsOn("hash_profile")))
+		assert.NoError(t, c.Set(rc.NewItem("hash_root").Value("root").CascadeTo(rc.CascadeStale, "hash_profile")))
+
+		n, err := c.HLen("hash_profile")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		_, err = c.HGet("hash_profile", "__rc:meta")
+		assert.Equal(t, rc.ErrReservedHashField, err)
+		assert.Equal(t, rc.ErrReservedHashField, c.HSet("hash_profile", "__rc:meta", "v"))
+
+		// Hash is deleted instead of being marked as stale, and cascades like a string record
+		assert.NoError(t, c.Del("hash_root"))
+		n, err = c.Conn().Exists("hash_root", "hash_profile", "hash_child", "hash_view", "__rc:dependents:hash_profile").Result()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+		c.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package relevantcache
+
+import (
+	"fmt"
+	"time"
+)
+
+// Outcome of Del or Unlink which is returned by DelWithResult and UnlinkWithResult
+type InvalidationResult struct {
+	// Keys which are given, including patterns. Invalid items are reported in Errors
+	Requested []string
+	// Keys which are resolved to be deleted, in order of resolved. Each key is either of Removed or Missing
+	Resolved []string
+	// Keys which are actually removed
+	Removed []string
+	// Keys which are already missing, e.g. expired or deleted by others while walking
+	Missing []string
+	// Errors on walking, key is cache key or pattern. Invalid items are keyed by their string form
+	Errors map[string]error
+	// Expansions of relevant keys with wildcard, in order of expanded
+	Expansions []WildcardExpansion
+	// Time taken to resolve and delete keys
+	Elapsed time.Duration
+
+	started  time.Time
+	resolved map[string]struct{}
+}
+
+func newInvalidationResult(items []interface{}) *InvalidationResult {
+	res := &InvalidationResult{
+		Requested:  []string{},
+		Resolved:   []string{},
+		Removed:    []string{},
+		Missing:    []string{},
+		Errors:     map[string]error{},
+		Expansions: []WildcardExpansion{},
+		started:    time.Now(),
+		resolved:   map[string]struct{}{},
+	}
+	for _, v := range items {
+		key, err := getKey(v)
+		if err != nil {
+			res.Errors[fmt.Sprintf("%v", v)] = err
+			continue
+		}
+		res.Requested = append(res.Requested, key)
+	}
+	return res
+}
+
+// Add resolved key with whether it's actually removed. Keys which are already added are ignored
+func (res *InvalidationResult) resolve(key string, removed bool) {
+	if _, ok := res.resolved[key]; ok {
+		return
+	}
+	res.resolved[key] = struct{}{}
+	res.Resolved = append(res.Resolved, key)
+	if removed {
+		res.Removed = append(res.Removed, key)
+	} else {
+		res.Missing = append(res.Missing, key)
+	}
+}
+
+// Fill errors and expansions of walking, and elapsed time. Returns nil if res is nil
+func finishResult(res *InvalidationResult, w *walkState) *InvalidationResult {
+	if res == nil {
+		return nil
+	}
+	for k, err := range w.errors {
+		if _, ok := res.Errors[k]; !ok {
+			res.Errors[k] = err
+		}
+	}
+	res.Expansions = append(res.Expansions, w.expansions...)
+	res.Elapsed = time.Since(res.started)
+	return res
+}
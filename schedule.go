@@ -0,0 +1,92 @@
+package relevantcache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Key of the schedule of delayed deletion on redis. The schedule is a ZSET of root keys with score of unix milliseconds
+// when they should be deleted, so that it survives restarts and any process which runs the worker can delete them.
+const scheduleKey = "__rc:schedule"
+
+// Key of leases of scheduled keys on redis. Claimed keys are moved to the ZSET with score of unix milliseconds
+// when the lease expires, and removed after they are deleted. Keys whose lease is expired are claimed again,
+// so that deletion which fails or is interrupted by crash of the worker is retried.
+const scheduleLeaseKey = "__rc:schedule:lease"
+
+// Duration of the lease of claimed keys, which is the interval of retrying failed deletion
+const scheduleLeaseTimeout = time.Minute
+
+// Count of keys which the worker deletes at once
+const scheduleBatchSize = 100
+
+// Key which is scheduled to be deleted on memory
+type scheduledKey struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+// Min-heap of scheduled keys ordered by time. Each key is scheduled once, and scheduling again replaces the time
+type scheduleHeap struct {
+	entries []*scheduledKey
+	keys    map[string]*scheduledKey
+}
+
+func newScheduleHeap() *scheduleHeap {
+	return &scheduleHeap{
+		keys: map[string]*scheduledKey{},
+	}
+}
+
+func (h *scheduleHeap) Len() int { return len(h.entries) }
+
+func (h *scheduleHeap) Less(i, j int) bool { return h.entries[i].at.Before(h.entries[j].at) }
+
+func (h *scheduleHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	e := x.(*scheduledKey)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+	h.keys[e.key] = e
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	n := len(h.entries)
+	e := h.entries[n-1]
+	h.entries = h.entries[:n-1]
+	delete(h.keys, e.key)
+	return e
+}
+
+// Schedule key at t, or replace time if key is already scheduled
+func (h *scheduleHeap) schedule(key string, t time.Time) {
+	if e, ok := h.keys[key]; ok {
+		e.at = t
+		heap.Fix(h, e.index)
+		return
+	}
+	heap.Push(h, &scheduledKey{key: key, at: t})
+}
+
+// Pop keys which are due at now
+func (h *scheduleHeap) due(now time.Time) []string {
+	keys := []string{}
+	for h.Len() > 0 && !h.entries[0].at.After(now) {
+		keys = append(keys, heap.Pop(h).(*scheduledKey).key)
+	}
+	return keys
+}
+
+// Time of the earliest key, false if nothing is scheduled
+func (h *scheduleHeap) next() (time.Time, bool) {
+	if h.Len() == 0 {
+		return time.Time{}, false
+	}
+	return h.entries[0].at, true
+}
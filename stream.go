@@ -0,0 +1,300 @@
+package relevantcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// Chunk size of streamed record when split buffer size is not specified
+	defaultStreamChunkSize = 512 * 1024
+	// Upper limit of header fields on streaming, to avoid allocating huge buffer by broken length
+	maxStreamHeaderFieldSize = 64 * 1024 * 1024
+)
+
+// Fetch single chunk data by key. missing chunk should be nil
+type streamChunkFetcher func(key string) ([]byte, error)
+
+func (o *recordOptions) streamChunkSize() int {
+	if o.splitBufferSize > 0 {
+		return int(o.splitBufferSize)
+	}
+	return defaultStreamChunkSize
+}
+
+// Write streamed data as the record for item.
+// Data is read by chunk size and passed to put as chunk except data which is fit in single chunk,
+// so caller never holds whole data in memory. Returns record header and keys of written chunks.
+//
+// Size of streamed data is unknown beforehand, so gzip compression is applied regardless of compress min size,
+// and snappy compression is not applied because snappy needs whole data. Encryption is applied by segments.
+// Checksum is calculated on reading data then header, because header is fixed after all chunks are written.
+func (o *recordOptions) writeStream(item *Item, src io.Reader, put func(c chunk) error) (*record, []string, error) {
+	key := item.cacheKey()
+	r := item.header(o.origin)
+
+	body := src
+	if o.compression == CompressionGzip {
+		pr, pw := io.Pipe()
+		go func() {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, src)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		// Unblock compressing goroutine when we stop reading on error
+		defer pr.Close()
+		body = pr
+		r.setSection(flagCompression, []byte{byte(CompressionGzip)})
+	}
+	if o.keyring != nil {
+		body = o.sealReader(key, r, body)
+	}
+
+	h := crc32.New(crc32cTable)
+	buf := make([]byte, o.streamChunkSize())
+	keys := []string{}
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		if i == 0 && err != nil {
+			// All data is fit in single chunk, store it in the record
+			r.data = append([]byte{}, buf[:n]...)
+			h.Write(r.data)
+			break
+		}
+		if n > 0 {
+			c := chunk{key: chunkKey(key, i), data: append([]byte{}, buf[:n]...)}
+			if err := put(c); err != nil {
+				return nil, nil, err
+			}
+			h.Write(c.data)
+			keys = append(keys, c.key)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(keys) > 0 {
+		r.setSection(flagChunks, encodeKeyList(keys))
+	}
+	if o.checksum {
+		r.flags |= flagChecksum
+		r.writeDigestHeader(h)
+		s := make([]byte, 5)
+		s[0] = checksumCRC32CDataFirst
+		binary.BigEndian.PutUint32(s[1:], h.Sum32())
+		r.setSection(flagChecksum, s)
+	}
+	return r, keys, nil
+}
+
+// Open stream of record data which follows header in src.
+// Chunks are fetched one by one on reading, and checksum is verified when stream reaches EOF.
+// Broken record is reported as *CorruptRecordError
+func (o *recordOptions) openStream(key string, r *record, src io.Reader, fetch streamChunkFetcher) (io.ReadCloser, error) {
+	keys, err := r.chunkKeys()
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	}
+	body := src
+	if len(keys) > 0 {
+		body = &chunkReader{key: key, keys: keys, fetch: fetch}
+	}
+	algo, sum, ok, err := r.checksum()
+	if err != nil {
+		return nil, corruptRecord(key, err)
+	} else if ok {
+		body = newChecksumReader(key, r, algo, sum, body)
+	}
+	if body, err = o.openReader(key, r, body); err != nil {
+		return nil, err
+	}
+	s := r.section(flagCompression)
+	if s == nil {
+		return ioutil.NopCloser(body), nil
+	}
+	if len(s) != 1 {
+		return nil, corruptRecord(key, fmt.Errorf("invalid compression section: %d bytes", len(s)))
+	}
+	switch Compression(s[0]) {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, corruptRecord(key, err)
+		}
+		return zr, nil
+	default:
+		// Other algorithms can't decompress partially, so read whole data
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decompress(Compression(s[0]), data); err != nil {
+			return nil, corruptRecord(key, err)
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// Decode record header from stream incrementally. Record data is left in br.
+// Returns nil record without error when data doesn't have any header (e.g. stored as primitive value).
+func decodeRecordHeader(br *bufio.Reader) (*record, error) {
+	head, err := br.Peek(len(recordMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case len(head) > 2 && head[0] == signatureSign && head[1] == nb:
+		br.Discard(2)
+		var size [2]byte
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			return nil, truncatedHeader(err)
+		}
+		keys, err := readStreamField(br, uint64(binary.BigEndian.Uint16(size[:])))
+		if err != nil {
+			return nil, truncatedHeader(err)
+		}
+		return &record{
+			version:  recordVersionLegacy,
+			keys:     keys,
+			sections: map[uint64][]byte{},
+		}, nil
+	case bytes.Equal(head, []byte(recordMagic)):
+		br.Discard(len(recordMagic))
+		r := &record{sections: map[uint64][]byte{}}
+		if r.version, err = br.ReadByte(); err != nil {
+			return nil, truncatedHeader(err)
+		} else if r.version != recordVersion {
+			return nil, fmt.Errorf("unsupported record version: %d", r.version)
+		}
+		if r.flags, err = binary.ReadUvarint(br); err != nil {
+			return nil, truncatedHeader(err)
+		}
+		if r.keys, err = readStreamChunk(br); err != nil {
+			return nil, truncatedHeader(err)
+		}
+		for bit := uint(0); bit < 64; bit++ {
+			flag := uint64(1) << bit
+			if r.flags&flag == 0 {
+				continue
+			}
+			if r.sections[flag], err = readStreamChunk(br); err != nil {
+				return nil, truncatedHeader(err)
+			}
+		}
+		return r, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Read length-prefixed bytes from stream
+func readStreamChunk(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	return readStreamField(br, size)
+}
+
+func readStreamField(br *bufio.Reader, size uint64) ([]byte, error) {
+	if size > maxStreamHeaderFieldSize {
+		return nil, fmt.Errorf("length %d exceeds limit of header field", size)
+	}
+	b := make([]byte, int(size))
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func truncatedHeader(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("record header is truncated")
+	}
+	return err
+}
+
+// Reader which concatenates chunks of split record, fetching a chunk when previous one is consumed
+type chunkReader struct {
+	key   string
+	keys  []string
+	fetch streamChunkFetcher
+	cur   []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.cur) == 0 {
+		if len(c.keys) == 0 {
+			return 0, io.EOF
+		}
+		b, err := c.fetch(c.keys[0])
+		if err != nil {
+			return 0, err
+		} else if b == nil {
+			return 0, corruptRecord(c.key, fmt.Errorf("chunk %s is missing", c.keys[0]))
+		}
+		c.cur = b
+		c.keys = c.keys[1:]
+	}
+	n := copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// Reader which calculates checksum of passed data and verifies it at EOF
+type checksumReader struct {
+	key    string
+	r      *record
+	algo   byte
+	expect uint32
+	src    io.Reader
+	h      hash.Hash32
+	err    error
+}
+
+func newChecksumReader(key string, r *record, algo byte, expect uint32, src io.Reader) *checksumReader {
+	h := crc32.New(crc32cTable)
+	if algo == checksumCRC32C {
+		r.writeDigestHeader(h)
+	}
+	return &checksumReader{
+		key:    key,
+		r:      r,
+		algo:   algo,
+		expect: expect,
+		src:    src,
+		h:      h,
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.src.Read(p)
+	c.h.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	if c.algo == checksumCRC32CDataFirst {
+		c.r.writeDigestHeader(c.h)
+	}
+	c.err = io.EOF
+	if actual := c.h.Sum32(); actual != c.expect {
+		c.err = corruptRecord(c.key, fmt.Errorf("checksum mismatch: expected %08x, actual %08x", c.expect, actual))
+	}
+	return n, c.err
+}
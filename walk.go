@@ -0,0 +1,352 @@
+package relevantcache
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Default limit of relevance depth
+const defaultMaxRelevanceDepth = 64
+
+// Prefix of the key which holds reverse dependency index on redis.
+// The index is a SET of dependent keys for each parent key.
+const dependentsKeyPrefix = "__rc:dependents:"
+
+func dependentsKey(parent string) string {
+	return dependentsKeyPrefix + parent
+}
+
+// Prefix of the key which holds tag index on redis. The index is a SET of tagged keys for each tag.
+const tagKeyPrefix = "__rc:tag:"
+
+func tagKey(tag string) string {
+	return tagKeyPrefix + tag
+}
+
+// Prefix of the key which holds the record header of expiring record on redis,
+// so that relevant keys can be resolved after the record is expired.
+const shadowKeyPrefix = "__rc:shadow:"
+
+func shadowKey(key string) string {
+	return shadowKeyPrefix + key
+}
+
+// Prefix of the key which is set by the process which cascades deletion of expired key, so that other processes skip it
+const expiredClaimKeyPrefix = "__rc:expired:"
+
+func expiredClaimKey(key string) string {
+	return expiredClaimKeyPrefix + key
+}
+
+// Report whether the key is an index which is maintained by this package
+func isIndexKey(key string) bool {
+	return strings.HasPrefix(key, dependentsKeyPrefix) ||
+		strings.HasPrefix(key, tagKeyPrefix) ||
+		strings.HasPrefix(key, shadowKeyPrefix) ||
+		strings.HasPrefix(key, expiredClaimKeyPrefix) ||
+		strings.HasPrefix(key, streamChunkKeyPrefix) ||
+		key == prefixIndexKey ||
+		key == prefixExpiryKey ||
+		key == scheduleKey ||
+		key == scheduleLeaseKey
+}
+
+// State of walking relevant keys for a deletion
+type walkState struct {
+	// Keys which are already walked, to avoid walking the same key twice
+	visited map[string]struct{}
+	// Keys from the root to current key
+	path []string
+	// Limit of depth to follow relevant keys and dependents, 0 means unlimited
+	maxDepth int
+	// Dependents which should be removed from reverse index, key is parent
+	unindex map[string][]string
+	// Keys which should be removed from tag index, key is tag
+	untag map[string][]string
+	// Records which are reached but kept with other actions than delete, in order of reached
+	kept     map[string]*keptRecord
+	keptKeys []string
+	// Expansions of relevant keys with wildcard, in order of expanded
+	expansions []WildcardExpansion
+	// Errors on walking, key is cache key or pattern. First error is kept for each key
+	errors map[string]error
+	// Keys which are reached for deletion but have no record, only on redis
+	absent []string
+	// Writer for debug events
+	w io.Writer
+	// Whether edges are recorded for InvalidationPlan
+	trace bool
+	edges []InvalidationEdge
+}
+
+func newWalkState(maxDepth int, w io.Writer) *walkState {
+	return &walkState{
+		visited:  map[string]struct{}{},
+		maxDepth: maxDepth,
+		unindex:  map[string][]string{},
+		untag:    map[string][]string{},
+		kept:     map[string]*keptRecord{},
+		errors:   map[string]error{},
+		w:        w,
+	}
+}
+
+// Enter key, and report whether key is visited first time.
+// leave() must be called after walking key when this returns true.
+// Cycle is reported as debug event, it's not an error because all keys in cycle are deleted at once.
+func (w *walkState) enter(key string) bool {
+	if w.isVisited(key) {
+		w.reportCycle(w.path, key)
+		return false
+	}
+	w.visited[key] = struct{}{}
+	w.path = append(w.path, key)
+	return true
+}
+
+func (w *walkState) leave() {
+	w.path = w.path[:len(w.path)-1]
+}
+
+// Check whether relations of current key can be followed.
+// Returns *RelevanceDepthError if current key is placed at the max depth
+func (w *walkState) descend() error {
+	return w.checkDepth(w.path)
+}
+
+func (w *walkState) isVisited(key string) bool {
+	_, ok := w.visited[key]
+	return ok
+}
+
+// Report cycle as debug event if key is placed in path
+func (w *walkState) reportCycle(path []string, key string) {
+	for i, k := range path {
+		if k == key {
+			cycle := append(append([]string{}, path[i:]...), key)
+			debug(w.w, fmt.Sprintf("[CYCLE] %s\n", strings.Join(cycle, " -> ")))
+			return
+		}
+	}
+}
+
+// Check whether relations of the last key in path can be followed
+func (w *walkState) checkDepth(path []string) error {
+	if w.maxDepth <= 0 || len(path) <= w.maxDepth {
+		return nil
+	}
+	key := path[len(path)-1]
+	debug(w.w, fmt.Sprintf("[DEPTH] relations of %s are not followed over max depth %d\n", key, w.maxDepth))
+	return w.fail(key, &RelevanceDepthError{
+		Key:   key,
+		Depth: w.maxDepth,
+		Path:  append([]string{}, path...),
+	})
+}
+
+// Record error of the key and return it as it is
+func (w *walkState) fail(key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := w.errors[key]; !ok {
+		w.errors[key] = err
+	}
+	return err
+}
+
+// Record edge which leads to key when tracing
+func (w *walkState) edge(from, to string, kind EdgeKind, pattern string) {
+	if !w.trace {
+		return
+	}
+	w.edges = append(w.edges, InvalidationEdge{
+		From:    from,
+		To:      to,
+		Kind:    kind,
+		Pattern: pattern,
+	})
+}
+
+// Get the last key in path, or empty string for roots
+func lastKey(path []string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return path[len(path)-1]
+}
+
+// Remember to remove deleted record from reverse index of its parents and from tag index
+func (w *walkState) unindexDependent(r *record, key string) {
+	parents, _ := r.dependsKeys()
+	for _, p := range parents {
+		w.unindex[p] = append(w.unindex[p], key)
+	}
+	for _, t := range r.tags() {
+		w.untag[t] = append(w.untag[t], key)
+	}
+}
+
+// Record expansion of wildcard pattern. Returns *WildcardBudgetError if it's stopped by budget
+func (w *walkState) expanded(e WildcardExpansion) error {
+	w.expansions = append(w.expansions, e)
+	if !e.Truncated() {
+		return nil
+	}
+	debug(w.w, fmt.Sprintf("[WILDCARD] expansion of %s is stopped by %s after %d matches\n", e.Pattern, e.Limit, len(e.Matched)))
+	return w.fail(e.Pattern, &WildcardBudgetError{
+		Pattern: e.Pattern,
+		Limit:   e.Limit,
+		Matched: len(e.Matched),
+	})
+}
+
+// Record which is reached by cascading deletion but kept with other action than delete
+type keptRecord struct {
+	action CascadeAction
+	// Stored data when the record is reached
+	data   []byte
+	chunks []string
+}
+
+// Keep the record with action instead of deleting it
+func (w *walkState) keep(key string, action CascadeAction, data []byte, chunks []string) {
+	debug(w.w, fmt.Sprintf("[REL] %s is kept with action %s\n", key, action))
+	w.kept[key] = &keptRecord{
+		action: action,
+		data:   data,
+		chunks: chunks,
+	}
+	w.keptKeys = append(w.keptKeys, key)
+}
+
+// Apply stronger action to the kept record when it's reached again by another edge
+func (w *walkState) strengthen(key string, edge CascadeAction) {
+	k, ok := w.kept[key]
+	if !ok {
+		return
+	}
+	r, _ := decodeRecord(k.data)
+	if action := resolveCascadeAction(r, []CascadeAction{edge}); action.stronger(k.action) {
+		debug(w.w, fmt.Sprintf("[REL] action of %s is changed to %s\n", key, action))
+		k.action = action
+	}
+}
+
+// Get keys of kept records whose action is changed to delete, with their chunks and dependents index.
+// They are also removed from indexes.
+func (w *walkState) keptDeletes() []string {
+	keys := []string{}
+	for _, key := range w.keptKeys {
+		k := w.kept[key]
+		if k.action != CascadeDelete {
+			continue
+		}
+		keys = append(keys, key)
+		keys = append(keys, k.chunks...)
+		keys = append(keys, dependentsKey(key))
+		if r, err := decodeRecord(k.data); err == nil && r != nil {
+			w.unindexDependent(r, key)
+		}
+	}
+	return keys
+}
+
+// Report whether the key is kept with other action than delete
+func (w *walkState) isKept(key string) bool {
+	k, ok := w.kept[key]
+	return ok && k.action != CascadeDelete
+}
+
+// Key which is found on breadth-first walking
+type walkNode struct {
+	key string
+	// Keys from the root to this node, excluding this node
+	path []string
+	// Parents which reach this node by reverse dependency index.
+	// Such node is walked only when its record still depends on one of them.
+	via []string
+	// Tags which reach this node by tag index.
+	// Such node is walked only when its record still has one of them.
+	tags []string
+	// Actions of edges which reach this node. Unset action is used for edges which don't specify it
+	actions []CascadeAction
+	// Whether this node is reached by relevant keys, so it's walked without condition
+	relevant bool
+	// Whether key is a wildcard pattern which is expanded to matched keys
+	wildcard bool
+}
+
+// Resolve action which is applied to this node. Roots are always deleted
+func (n *walkNode) action(r *record) CascadeAction {
+	if len(n.path) == 0 {
+		return CascadeDelete
+	}
+	return resolveCascadeAction(r, n.actions)
+}
+
+// Walk this node only if the record satisfies the condition how this node is reached
+func (n *walkNode) accepts(r *record) bool {
+	if n.relevant {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	for _, p := range n.via {
+		if r.dependsOn(p) {
+			return true
+		}
+	}
+	for _, t := range n.tags {
+		if r.hasTag(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys which are walked in the next level, in order of found
+type walkFrontier struct {
+	nodes []*walkNode
+	index map[string]*walkNode
+}
+
+func newWalkFrontier() *walkFrontier {
+	return &walkFrontier{
+		index: map[string]*walkNode{},
+	}
+}
+
+// Add key which is found from path. via is the parent if key is found by reverse dependency index.
+// action is the action of the edge, roots and dependents use unset action.
+func (f *walkFrontier) add(key string, path []string, via string, action CascadeAction) *walkNode {
+	n := f.node(key, path)
+	n.actions = append(n.actions, action)
+	if via == "" {
+		n.relevant = true
+	} else {
+		n.via = append(n.via, via)
+	}
+	return n
+}
+
+// Add key which is found by tag index
+func (f *walkFrontier) addTagged(key string, tag string) {
+	n := f.node(key, nil)
+	n.tags = append(n.tags, tag)
+}
+
+func (f *walkFrontier) node(key string, path []string) *walkNode {
+	n, ok := f.index[key]
+	if !ok {
+		n = &walkNode{
+			key:  key,
+			path: path,
+		}
+		f.index[key] = n
+		f.nodes = append(f.nodes, n)
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+package relevantcache
+
+import (
+	"time"
+)
+
+// Key of the prefix index on redis. The index is a ZSET of all keys which are set by this package with score 0,
+// so keys which share a prefix are listed by ZRANGEBYLEX without scanning the keyspace.
+const prefixIndexKey = "__rc:prefix"
+
+// Key of expiration of the prefix index. Keys which have TTL are kept in the ZSET with score of expiration in unix milliseconds,
+// and members of expired keys are pruned from both of ZSETs before expansion.
+const prefixExpiryKey = "__rc:prefix:expiry"
+
+// Limits of expanding a relevant key with wildcard. Each limit is applied to a pattern, zero means unlimited
+type WildcardBudget struct {
+	// Max count of keys which are scanned
+	MaxScanned int
+	// Max count of keys which match the pattern
+	MaxMatches int
+	// Time limit of scanning. It's not applied to atomic delete because the script can't measure time
+	Timeout time.Duration
+}
+
+// Limit of WildcardBudget which stops expansion
+type WildcardLimit string
+
+const (
+	WildcardMaxScanned WildcardLimit = "max_scanned"
+	WildcardMaxMatches WildcardLimit = "max_matches"
+	WildcardTimeout    WildcardLimit = "timeout"
+)
+
+// Keys which a wildcard pattern is expanded to
+type WildcardExpansion struct {
+	// Key whose record has the pattern, empty for the pattern which is given as root
+	From    string
+	Pattern string
+	Matched []string
+	// Count of keys which are scanned. On redis without prefix index, it's estimated by COUNT of SCAN
+	Scanned int
+	// Limit which stops expansion, empty if expansion is completed. Matched is partial when it's set
+	Limit WildcardLimit
+}
+
+// Report whether expansion is stopped by budget
+func (e WildcardExpansion) Truncated() bool {
+	return e.Limit != ""
+}
+
+// Expansion of a pattern which is limited by budget
+type wildcardScanner struct {
+	budget  WildcardBudget
+	started time.Time
+	e       WildcardExpansion
+}
+
+func newWildcardScanner(from, pattern string, budget WildcardBudget) *wildcardScanner {
+	return &wildcardScanner{
+		budget:  budget,
+		started: time.Now(),
+		e: WildcardExpansion{
+			From:    from,
+			Pattern: pattern,
+			Matched: []string{},
+		},
+	}
+}
+
+// Count scanned keys and add matched keys. Keys over max matches are dropped
+func (s *wildcardScanner) add(scanned int, matched ...string) {
+	s.e.Scanned += scanned
+	for _, k := range matched {
+		if s.budget.MaxMatches > 0 && len(s.e.Matched) >= s.budget.MaxMatches {
+			s.e.Limit = WildcardMaxMatches
+			return
+		}
+		s.e.Matched = append(s.e.Matched, k)
+	}
+}
+
+// Report whether scanning can continue within budget.
+// Reaching max matches doesn't stop scanning, the limit is set only when a further match is dropped
+func (s *wildcardScanner) next() bool {
+	switch {
+	case s.e.Limit != "":
+	case s.budget.MaxScanned > 0 && s.e.Scanned >= s.budget.MaxScanned:
+		s.e.Limit = WildcardMaxScanned
+	case s.budget.Timeout > 0 && time.Since(s.started) >= s.budget.Timeout:
+		s.e.Limit = WildcardTimeout
+	default:
+		return true
+	}
+	return false
+}
+
+// Count of keys which are scanned in next batch
+func (s *wildcardScanner) batch(size int) int {
+	if s.budget.MaxScanned > 0 && s.budget.MaxScanned-s.e.Scanned < size {
+		return s.budget.MaxScanned - s.e.Scanned
+	}
+	return size
+}
+
+// Literal prefix of glob pattern, which every matched key starts with
+func globPrefix(pattern string) string {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '*' || c == '?' || c == '[' {
+			break
+		}
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+		prefix = append(prefix, c)
+	}
+	return string(prefix)
+}